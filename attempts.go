@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const defaultChainMaxAttempts = 16
+
+// chainMaxAttempts bounds how many combos one request may try.
+var chainMaxAttempts = defaultChainMaxAttempts
+
+// chainDialTimeout bounds the whole search, when set.
+var chainDialTimeout time.Duration
+
+// hopError is a failure on combo[index] while building a chain. target is
+// set when the proxy itself worked but could not reach what it was asked
+// to, the next proxy or the destination.
+type hopError struct {
+	index  int
+	proxy  string
+	target bool
+	err    error
+}
+
+func (e *hopError) Error() string { return fmt.Sprintf("hop %s: %v", e.proxy, e.err) }
+
+func (e *hopError) Unwrap() error { return e.err }
+
+// failedPrefix returns how many leading proxies of a failed combo of n
+// hops the failure is attributed to: the failing proxy and the ones before
+// it, plus the next one when that is what could not be reached. Later hops
+// are not to blame.
+func failedPrefix(err error, n int) int {
+	var he *hopError
+	if !errors.As(err, &he) {
+		return n
+	}
+	blamed := he.index + 1
+	if he.target {
+		blamed++
+	}
+	return min(blamed, n)
+}
+
+type chainAttempt struct {
+	combo []*Proxy
+	err   error
+}
+
+// chainAttempts is the search state of one request: the attempts made so
+// far and the combo prefixes known to fail.
+type chainAttempts struct {
+	max      int
+	started  int
+	attempts []chainAttempt
+	failed   [][]*Proxy
+}
+
+func newChainAttempts() *chainAttempts {
+	return &chainAttempts{max: chainMaxAttempts}
+}
+
+func (a *chainAttempts) exhausted() bool {
+	return a.max > 0 && a.started >= a.max
+}
+
+func (a *chainAttempts) record(combo []*Proxy, err error) {
+	combo = append([]*Proxy(nil), combo...)
+	a.attempts = append(a.attempts, chainAttempt{combo: combo, err: err})
+	a.failed = append(a.failed, combo[:failedPrefix(err, len(combo))])
+}
+
+// blocked reports whether the partial combo starts with a prefix that
+// already failed, so completing it cannot succeed.
+func (a *chainAttempts) blocked(partial []*Proxy) bool {
+outer:
+	for _, f := range a.failed {
+		if len(f) > len(partial) {
+			continue
+		}
+		for i := range f {
+			if f[i] != partial[i] {
+				continue outer
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// err summarizes the failed attempts.
+func (a *chainAttempts) err() error {
+	if len(a.attempts) == 0 {
+		return fmt.Errorf("no valid proxy chain")
+	}
+	return &chainError{attempts: a.attempts, exhausted: a.exhausted()}
+}
+
+// chainError lists which hop failed on each attempt of a request.
+type chainError struct {
+	attempts  []chainAttempt
+	exhausted bool
+}
+
+func (e *chainError) Error() string {
+	if len(e.attempts) == 1 {
+		return e.attempts[0].err.Error()
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d chain attempts failed", len(e.attempts))
+	if e.exhausted {
+		b.WriteString(" (attempt limit reached)")
+	}
+	for i, at := range e.attempts {
+		names := make([]string, len(at.combo))
+		for j, p := range at.combo {
+			names[j] = p.Name
+		}
+		fmt.Fprintf(&b, "; [%d] %s: %v", i+1, strings.Join(names, ">"), at.err)
+	}
+	return b.String()
+}
+
+// Unwrap returns the last failure, so a context error that ended the
+// search can be detected with errors.Is.
+func (e *chainError) Unwrap() error { return e.attempts[len(e.attempts)-1].err }
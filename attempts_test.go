@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// closedPort returns a loopback port nothing listens on.
+func closedPort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	return port
+}
+
+func TestChainAttemptsBlocked(t *testing.T) {
+	a, b, c, d := &Proxy{Name: "a"}, &Proxy{Name: "b"}, &Proxy{Name: "c"}, &Proxy{Name: "d"}
+	att := &chainAttempts{}
+	att.record([]*Proxy{a, b, c}, &hopError{index: 0, proxy: "a", target: true, err: errors.New("refused")})
+	if !att.blocked([]*Proxy{a, b, d}) {
+		t.Fatal("combos through a to b should be blocked")
+	}
+	if att.blocked([]*Proxy{a, d, c}) {
+		t.Fatal("a may still reach d")
+	}
+	att.record([]*Proxy{d, b, c}, &hopError{index: 2, proxy: "c", err: errors.New("refused")})
+	if att.blocked([]*Proxy{d, b, a}) {
+		t.Fatal("a failure on the last hop only blocks its own combo")
+	}
+	att.record([]*Proxy{b, c, d}, &hopError{index: 0, proxy: "b", err: errors.New("dial failed")})
+	if !att.blocked([]*Proxy{b, a}) {
+		t.Fatal("a proxy that cannot be talked to should be blocked with any next hop")
+	}
+}
+
+func dialThreeHops(t *testing.T) error {
+	t.Helper()
+	bad0 := &Proxy{Name: "bad0", Host: "127.0.0.1", Port: closedPort(t)}
+	bad1 := &Proxy{Name: "bad1", Host: "127.0.0.1", Port: closedPort(t)}
+	mid := &Proxy{Name: "mid", Host: "127.0.0.1", Port: 1}
+	var last []*Proxy
+	for i, n := range []string{"p", "q", "r"} {
+		last = append(last, &Proxy{Name: n, Host: "127.0.0.1", Port: 2 + i})
+	}
+	cfg := Config{Chains: []UserChain{{Username: "u", Chain: []*Hop{
+		{Proxies: []*Proxy{bad0, bad1}},
+		{Proxies: []*Proxy{mid}},
+		{Proxies: last},
+	}}}}
+	initProxies(&cfg)
+	state := &ChainState{name: "u", chain: cfg.Chains[0].Chain}
+	_, err := dialChain(t.Context(), state, "127.0.0.1", 1)
+	if err == nil {
+		t.Fatal("expected chain to fail")
+	}
+	return err
+}
+
+func TestDialChainSkipsFailedPrefixes(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog = origWarn, origDebug }()
+
+	err := dialThreeHops(t)
+	var ce *chainError
+	if !errors.As(err, &ce) {
+		t.Fatalf("expected chainError, got %T: %v", err, err)
+	}
+	// Each first hop fails once; the last hop's permutations are skipped.
+	if len(ce.attempts) != 2 {
+		t.Fatalf("expected 2 attempts, got %d: %v", len(ce.attempts), err)
+	}
+	msg := err.Error()
+	for _, want := range []string{"2 chain attempts failed", "[1] bad0>mid>", "hop bad0:", "[2] bad1>mid>", "hop bad1:"} {
+		if !strings.Contains(msg, want) {
+			t.Fatalf("error %q does not mention %q", msg, want)
+		}
+	}
+}
+
+func TestDialChainSkipsDeadProxy(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog = origWarn, origDebug }()
+
+	bad := &Proxy{Name: "bad", Host: "127.0.0.1", Port: closedPort(t)}
+	var mids []*Proxy
+	for i, n := range []string{"m1", "m2", "m3"} {
+		mids = append(mids, &Proxy{Name: n, Host: "127.0.0.1", Port: 2 + i})
+	}
+	cfg := Config{Chains: []UserChain{{Username: "u", Chain: []*Hop{
+		{Proxies: []*Proxy{bad}},
+		{Proxies: mids},
+	}}}}
+	initProxies(&cfg)
+	state := &ChainState{name: "u", chain: cfg.Chains[0].Chain}
+	_, err := dialChain(t.Context(), state, "127.0.0.1", 1)
+	var he *hopError
+	if !errors.As(err, &he) || he.proxy != "bad" {
+		t.Fatalf("expected a single failure at hop bad, got %v", err)
+	}
+	if strings.Contains(err.Error(), "chain attempts failed") {
+		t.Fatalf("a dead first hop was retried with each next proxy: %v", err)
+	}
+}
+
+func TestDialChainAttemptLimit(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	origMax := chainMaxAttempts
+	chainMaxAttempts = 1
+	defer func() {
+		warnLog, debugLog = origWarn, origDebug
+		chainMaxAttempts = origMax
+	}()
+
+	var ce *chainError
+	if err := dialThreeHops(t); !errors.As(err, &ce) || len(ce.attempts) != 1 || !ce.exhausted {
+		t.Fatalf("expected a single attempt, got %v", err)
+	}
+}
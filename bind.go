@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// handleBind serves a BIND request using the two-reply flow from RFC 1928:
+// the first reply announces where the peer should connect and the second
+// one reports the peer once it has connected.
+func handleBind(ctx context.Context, conn net.Conn, state *ChainState, host string, port int) {
+	if state != nil && len(state.chain) > 0 {
+		bindChain(ctx, conn, state, host, port)
+		return
+	}
+	var lip net.IP
+	if la, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		lip = la.IP
+	}
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: lip})
+	if err != nil {
+		warnLog.Printf("bind listen: %v, code 0x01", err)
+		conn.SetDeadline(time.Now().Add(ioTimeout))
+		if err := writeFull(conn, encodeReply(0x01, "0.0.0.0", 0)); err != nil {
+			warnLog.Printf("write: %v", err)
+		}
+		return
+	}
+	defer ln.Close()
+	la := ln.Addr().(*net.TCPAddr)
+	lhost := la.IP.String()
+	if la.IP.IsUnspecified() {
+		lhost = "0.0.0.0"
+	}
+	resp := encodeReply(0x00, lhost, la.Port)
+	conn.SetDeadline(time.Now().Add(ioTimeout))
+	if err := writeFull(conn, resp); err != nil {
+		warnLog.Printf("write: %v", err)
+		return
+	}
+	debugLog.Printf("bind listening on %s", la)
+	stop := watchControl(conn, ln)
+	ln.SetDeadline(time.Now().Add(bindTimeout))
+	peer, err := ln.AcceptTCP()
+	if stop() {
+		if peer != nil {
+			peer.Close()
+		}
+		debugLog.Printf("bind: client closed the control connection")
+		return
+	}
+	if err != nil {
+		code := byte(0x01)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			code = 0x06
+		}
+		warnLog.Printf("bind accept: %v, code 0x%02X", err, code)
+		conn.SetDeadline(time.Now().Add(ioTimeout))
+		if err := writeFull(conn, encodeReply(code, "0.0.0.0", 0)); err != nil {
+			warnLog.Printf("write: %v", err)
+		}
+		return
+	}
+	defer peer.Close()
+	pa := peer.RemoteAddr().(*net.TCPAddr)
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() && !ip.Equal(pa.IP) {
+		warnLog.Printf("bind: unexpected peer %s, want %s, code 0x02", pa, host)
+		conn.SetDeadline(time.Now().Add(ioTimeout))
+		if err := writeFull(conn, encodeReply(0x02, "0.0.0.0", 0)); err != nil {
+			warnLog.Printf("write: %v", err)
+		}
+		return
+	}
+	peer.SetNoDelay(true)
+	resp = encodeReply(0x00, pa.IP.String(), pa.Port)
+	conn.SetDeadline(time.Now().Add(ioTimeout))
+	if err := writeFull(conn, resp); err != nil {
+		warnLog.Printf("write: %v", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	debugLog.Printf("bind peer %s connected", pa)
+	proxy(peer, conn)
+}
+
+// bindChain issues BIND on the last hop of the user's chain and relays both
+// of its replies back to the client.
+func bindChain(ctx context.Context, conn net.Conn, state *ChainState, host string, port int) {
+	state.acquire()
+	defer state.release()
+	ctx, cancel := context.WithTimeout(ctx, ioTimeout)
+	upstream, bnd, err := requestChain(ctx, state, 0x02, host, port)
+	cancel()
+	if err != nil {
+		warnLog.Printf("bind through chain failed: %v, code 0x04", err)
+		conn.SetDeadline(time.Now().Add(ioTimeout))
+		if err := writeFull(conn, encodeReply(0x04, "0.0.0.0", 0)); err != nil {
+			warnLog.Printf("write: %v", err)
+		}
+		return
+	}
+	defer upstream.Close()
+	resp := encodeReply(0x00, bnd.host, bnd.port)
+	conn.SetDeadline(time.Now().Add(ioTimeout))
+	if err := writeFull(conn, resp); err != nil {
+		warnLog.Printf("write: %v", err)
+		return
+	}
+	debugLog.Printf("upstream bind listening on %s:%d", bnd.host, bnd.port)
+	stop := watchControl(conn, upstream)
+	rep, peer, err := readReply(upstream, bindTimeout)
+	if stop() {
+		debugLog.Printf("bind: client closed the control connection")
+		return
+	}
+	if err != nil {
+		code := byte(0x01)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			code = 0x06
+		}
+		warnLog.Printf("bind second reply: %v, code 0x%02X", err, code)
+		conn.SetDeadline(time.Now().Add(ioTimeout))
+		if err := writeFull(conn, encodeReply(code, "0.0.0.0", 0)); err != nil {
+			warnLog.Printf("write: %v", err)
+		}
+		return
+	}
+	resp = encodeReply(rep, peer.host, peer.port)
+	conn.SetDeadline(time.Now().Add(ioTimeout))
+	if err := writeFull(conn, resp); err != nil {
+		warnLog.Printf("write: %v", err)
+		return
+	}
+	if rep != 0x00 {
+		warnLog.Printf("upstream bind failed, code 0x%02X", rep)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	upstream.SetDeadline(time.Time{})
+	debugLog.Printf("bind peer %s:%d connected", peer.host, peer.port)
+	proxy(upstream, conn)
+}
+
+// watchControl closes c once the client closes conn while a BIND waits for
+// its peer. The client must not send anything before the second reply, so
+// data counts as going away too. The returned stop ends the watch before
+// conn is used again and reports whether c was closed.
+func watchControl(conn net.Conn, c io.Closer) (stop func() bool) {
+	conn.SetReadDeadline(time.Time{})
+	done := make(chan struct{})
+	var gone bool
+	go func() {
+		defer close(done)
+		var b [1]byte
+		if _, err := conn.Read(b[:]); errors.Is(err, os.ErrDeadlineExceeded) {
+			return
+		}
+		gone = true
+		c.Close()
+	}()
+	return func() bool {
+		conn.SetReadDeadline(time.Now())
+		<-done
+		return gone
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// bindFirstReply performs a no-auth BIND handshake on client and returns
+// the port from the first reply.
+func bindFirstReply(t *testing.T, client net.Conn) int {
+	t.Helper()
+	if _, err := client.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		t.Fatalf("handshake write: %v", err)
+	}
+	buf := make([]byte, 10)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(client, buf[:2]); err != nil {
+		t.Fatalf("handshake read: %v", err)
+	}
+	if _, err := client.Write([]byte{0x05, 0x02, 0x00, 0x01, 127, 0, 0, 1, 0, 0}); err != nil {
+		t.Fatalf("bind write: %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatalf("first reply read: %v", err)
+	}
+	if buf[1] != 0x00 {
+		t.Fatalf("expected first reply 0x00, got 0x%02X", buf[1])
+	}
+	return int(buf[8])<<8 | int(buf[9])
+}
+
+func bindPeerExchange(t *testing.T, client net.Conn, port int) {
+	t.Helper()
+	peer, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("peer dial: %v", err)
+	}
+	defer peer.Close()
+	buf := make([]byte, 10)
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatalf("second reply read: %v", err)
+	}
+	if buf[1] != 0x00 {
+		t.Fatalf("expected second reply 0x00, got 0x%02X", buf[1])
+	}
+	if _, err := peer.Write([]byte("ping")); err != nil {
+		t.Fatalf("peer write: %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(client, buf[:4]); err != nil {
+		t.Fatalf("client read: %v", err)
+	}
+	if string(buf[:4]) != "ping" {
+		t.Fatalf("unexpected data %q", buf[:4])
+	}
+}
+
+func TestHandleConnBind(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog = origWarn, origDebug }()
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() { handleConn(server, nil, &Listener{}); close(done) }()
+
+	port := bindFirstReply(t, client)
+	bindPeerExchange(t, client, port)
+
+	client.Close()
+	<-done
+}
+
+func TestHandleConnBindTimeout(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	orig := bindTimeout
+	bindTimeout = 50 * time.Millisecond
+	defer func() {
+		warnLog, debugLog = origWarn, origDebug
+		bindTimeout = orig
+	}()
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() { handleConn(server, nil, &Listener{}); close(done) }()
+
+	bindFirstReply(t, client)
+	buf := make([]byte, 10)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatalf("second reply read: %v", err)
+	}
+	if buf[1] != 0x06 {
+		t.Fatalf("expected second reply 0x06, got 0x%02X", buf[1])
+	}
+	client.Close()
+	<-done
+}
+
+func TestHandleConnBindClientGone(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog = origWarn, origDebug }()
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() { handleConn(server, nil, &Listener{}); close(done) }()
+
+	port := bindFirstReply(t, client)
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("bind kept waiting after the client went away")
+	}
+	if c, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err == nil {
+		c.Close()
+		t.Fatal("bind listener still open")
+	}
+}
+
+func TestHandleConnBindChain(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog = origWarn, origDebug }()
+
+	ln := startTestServer(t, &Listener{}, nil)
+	defer ln.Close()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	cfg := Config{Chains: []UserChain{{Username: "u", Password: "p", Chain: []*Hop{{Name: "up", Host: "127.0.0.1", Port: addr.Port}}}}}
+	initProxies(&cfg)
+	chains, err := buildUserChains(cfg.Chains)
+	if err != nil {
+		t.Fatalf("build chains: %v", err)
+	}
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() { handleConn(server, chains, &Listener{}); close(done) }()
+
+	if _, err := client.Write([]byte{0x05, 0x01, 0x02}); err != nil {
+		t.Fatalf("handshake write: %v", err)
+	}
+	buf := make([]byte, 10)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(client, buf[:2]); err != nil {
+		t.Fatalf("handshake read: %v", err)
+	}
+	if _, err := client.Write([]byte{0x01, 0x01, 'u', 0x01, 'p'}); err != nil {
+		t.Fatalf("auth write: %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(client, buf[:2]); err != nil {
+		t.Fatalf("auth read: %v", err)
+	}
+	if buf[1] != 0x00 {
+		t.Fatalf("auth failed: 0x%02X", buf[1])
+	}
+	if _, err := client.Write([]byte{0x05, 0x02, 0x00, 0x01, 127, 0, 0, 1, 0, 0}); err != nil {
+		t.Fatalf("bind write: %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatalf("first reply read: %v", err)
+	}
+	if buf[1] != 0x00 {
+		t.Fatalf("expected first reply 0x00, got 0x%02X", buf[1])
+	}
+	bindPeerExchange(t, client, int(buf[8])<<8|int(buf[9]))
+
+	client.Close()
+	<-done
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerFailures    = 3
+	defaultBreakerErrorRate   = 0.5
+	defaultBreakerMinRequests = 10
+	defaultBreakerWindow      = time.Minute
+	defaultBreakerOpenTimeout = 30 * time.Second
+
+	breakerBuckets = 10
+)
+
+// CircuitBreaker configures how results of real connections take a proxy
+// out of rotation and bring it back.
+type CircuitBreaker struct {
+	// Failures is the number of consecutive failures that opens the
+	// circuit.
+	Failures int `yaml:"failures"`
+	// ErrorRate opens the circuit once this share of the requests in
+	// Window failed, provided there were at least MinRequests.
+	ErrorRate   float64       `yaml:"error_rate"`
+	MinRequests int           `yaml:"min_requests"`
+	Window      time.Duration `yaml:"window"`
+	// OpenTimeout is how long an open circuit waits before letting a
+	// single probe connection through.
+	OpenTimeout time.Duration `yaml:"open_timeout"`
+}
+
+var breakerSettings = CircuitBreaker{
+	Failures:    defaultBreakerFailures,
+	ErrorRate:   defaultBreakerErrorRate,
+	MinRequests: defaultBreakerMinRequests,
+	Window:      defaultBreakerWindow,
+	OpenTimeout: defaultBreakerOpenTimeout,
+}
+
+// withDefaults fills unset fields of cb.
+func (cb *CircuitBreaker) withDefaults() CircuitBreaker {
+	s := CircuitBreaker{}
+	if cb != nil {
+		s = *cb
+	}
+	if s.Failures == 0 {
+		s.Failures = defaultBreakerFailures
+	}
+	if s.ErrorRate == 0 {
+		s.ErrorRate = defaultBreakerErrorRate
+	}
+	if s.MinRequests == 0 {
+		s.MinRequests = defaultBreakerMinRequests
+	}
+	if s.Window == 0 {
+		s.Window = defaultBreakerWindow
+	}
+	if s.OpenTimeout == 0 {
+		s.OpenTimeout = defaultBreakerOpenTimeout
+	}
+	return s
+}
+
+func validateCircuitBreaker(cb *CircuitBreaker) error {
+	if cb == nil {
+		return nil
+	}
+	if cb.Failures < 0 {
+		return fmt.Errorf("circuit_breaker.failures must be positive")
+	}
+	if cb.ErrorRate < 0 || cb.ErrorRate > 1 {
+		return fmt.Errorf("circuit_breaker.error_rate must be between 0 and 1")
+	}
+	if cb.MinRequests < 0 {
+		return fmt.Errorf("circuit_breaker.min_requests must be positive")
+	}
+	if cb.Window < 0 {
+		return fmt.Errorf("circuit_breaker.window must be positive")
+	}
+	if cb.OpenTimeout < 0 {
+		return fmt.Errorf("circuit_breaker.open_timeout must be positive")
+	}
+	return nil
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+type breakerBucket struct {
+	epoch  int64
+	ok     int
+	failed int
+}
+
+// breaker tracks the outcome of connections through a proxy. While the
+// circuit is open the proxy's alive flag is cleared, so orderedProxies
+// skips it except for the probe let through in the half-open state.
+type breaker struct {
+	mu          sync.Mutex
+	state       breakerState
+	consecutive int
+	openedAt    time.Time
+	probeAt     time.Time
+	// healthDown is set while the periodic health check fails, which
+	// also holds back probes.
+	healthDown bool
+	// healthRun counts consecutive passed (positive) or failed
+	// (negative) health checks.
+	healthRun int
+	buckets   [breakerBuckets]breakerBucket
+}
+
+func bucketEpoch(now time.Time) int64 {
+	return now.UnixNano() / max(int64(breakerSettings.Window/breakerBuckets), 1)
+}
+
+// bucket returns the window bucket for now, resetting it if it is stale.
+// b.mu must be held.
+func (b *breaker) bucket(now time.Time) *breakerBucket {
+	epoch := bucketEpoch(now)
+	bk := &b.buckets[epoch%breakerBuckets]
+	if bk.epoch != epoch {
+		*bk = breakerBucket{epoch: epoch}
+	}
+	return bk
+}
+
+// errorRate returns the share of failed requests in the window and the
+// number of requests it is based on. b.mu must be held.
+func (b *breaker) errorRate(now time.Time) (float64, int) {
+	epoch := bucketEpoch(now)
+	var ok, failed int
+	for _, bk := range b.buckets {
+		if epoch-bk.epoch < breakerBuckets {
+			ok += bk.ok
+			failed += bk.failed
+		}
+	}
+	total := ok + failed
+	if total == 0 {
+		return 0, 0
+	}
+	return float64(failed) / float64(total), total
+}
+
+// reportSuccess records a connection that got through the proxy.
+func (p *Proxy) reportSuccess() {
+	b := &p.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bucket(time.Now()).ok++
+	b.consecutive = 0
+	if b.state == breakerHalfOpen {
+		b.state = breakerClosed
+		if !b.healthDown {
+			infoLog.Printf("proxy %s circuit closed", p.Name)
+			p.alive.Store(true)
+			p.markRecovered()
+		}
+	}
+}
+
+// reportFailure records a connection that failed on the proxy and opens
+// the circuit once the configured thresholds are crossed.
+func (p *Proxy) reportFailure() {
+	b := &p.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.bucket(now).failed++
+	b.consecutive++
+	switch b.state {
+	case breakerHalfOpen:
+		warnLog.Printf("proxy %s probe failed, circuit reopened", p.Name)
+	case breakerClosed:
+		rate, n := b.errorRate(now)
+		switch {
+		case b.consecutive >= breakerSettings.Failures:
+			warnLog.Printf("proxy %s circuit opened after %d consecutive failures", p.Name, b.consecutive)
+		case n >= breakerSettings.MinRequests && rate >= breakerSettings.ErrorRate:
+			warnLog.Printf("proxy %s circuit opened at %.0f%% errors over %d requests", p.Name, rate*100, n)
+		default:
+			return
+		}
+	default:
+		return
+	}
+	b.state = breakerOpen
+	b.openedAt = now
+	p.alive.Store(false)
+}
+
+// tryProbe reports whether an open circuit lets a probe connection
+// through. Only one probe is let through per open_timeout.
+func (p *Proxy) tryProbe() bool {
+	b := &p.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	switch {
+	case b.healthDown:
+		return false
+	case b.state == breakerOpen && now.Sub(b.openedAt) >= breakerSettings.OpenTimeout:
+		b.state = breakerHalfOpen
+	case b.state == breakerHalfOpen && now.Sub(b.probeAt) >= breakerSettings.OpenTimeout:
+		// The last probe was never used or never reported back.
+	default:
+		return false
+	}
+	b.probeAt = now
+	debugLog.Printf("proxy %s circuit half-open, probing", p.Name)
+	return true
+}
+
+// reportHealth applies a periodic health check result. The proxy is
+// marked dead after fall consecutive failures and revived after rise
+// consecutive successes, unless its circuit is open; that one has to pass
+// a probe first.
+func (p *Proxy) reportHealth(ok bool, rise, fall int) {
+	b := &p.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ok {
+		b.healthRun = max(b.healthRun, 0) + 1
+	} else {
+		b.healthRun = min(b.healthRun, 0) - 1
+	}
+	switch {
+	case !ok && -b.healthRun >= fall:
+		b.healthDown = true
+		if p.alive.Load() {
+			warnLog.Printf("proxy %s marked dead", p.Name)
+			p.alive.Store(false)
+		}
+	case ok && b.healthRun >= rise:
+		b.healthDown = false
+		if b.state == breakerClosed && !p.alive.Load() {
+			infoLog.Printf("proxy %s recovered", p.Name)
+			p.alive.Store(true)
+			p.markRecovered()
+		}
+	}
+}
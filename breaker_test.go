@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func withBreakerSettings(t *testing.T, s CircuitBreaker) {
+	t.Helper()
+	origWarn, origInfo, origDebug := warnLog, infoLog, debugLog
+	warnLog, infoLog, debugLog = nopLogger{}, nopLogger{}, nopLogger{}
+	orig := breakerSettings
+	breakerSettings = s.withDefaults()
+	t.Cleanup(func() {
+		warnLog, infoLog, debugLog = origWarn, origInfo, origDebug
+		breakerSettings = orig
+	})
+}
+
+func TestBreakerConsecutiveFailures(t *testing.T) {
+	withBreakerSettings(t, CircuitBreaker{Failures: 3, OpenTimeout: 20 * time.Millisecond})
+	p := aliveProxy("p")
+	p.reportFailure()
+	p.reportFailure()
+	if !p.alive.Load() {
+		t.Fatal("circuit opened before the threshold")
+	}
+	p.reportFailure()
+	if p.alive.Load() {
+		t.Fatal("circuit did not open after 3 failures")
+	}
+	if p.tryProbe() {
+		t.Fatal("probe allowed before open_timeout")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if !p.tryProbe() {
+		t.Fatal("probe not allowed after open_timeout")
+	}
+	if p.tryProbe() {
+		t.Fatal("second concurrent probe allowed")
+	}
+	p.reportFailure()
+	if p.alive.Load() || p.tryProbe() {
+		t.Fatal("failed probe should reopen the circuit")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if !p.tryProbe() {
+		t.Fatal("probe not allowed after reopening")
+	}
+	p.reportSuccess()
+	if !p.alive.Load() {
+		t.Fatal("successful probe did not close the circuit")
+	}
+}
+
+func TestBreakerErrorRate(t *testing.T) {
+	withBreakerSettings(t, CircuitBreaker{Failures: 100, ErrorRate: 0.5, MinRequests: 4})
+	p := aliveProxy("p")
+	p.reportSuccess()
+	p.reportFailure()
+	p.reportSuccess()
+	if !p.alive.Load() {
+		t.Fatal("circuit opened below min_requests")
+	}
+	p.reportFailure()
+	if p.alive.Load() {
+		t.Fatal("circuit did not open at 50% errors")
+	}
+}
+
+func TestBreakerHealthCheck(t *testing.T) {
+	withBreakerSettings(t, CircuitBreaker{Failures: 1, OpenTimeout: time.Nanosecond})
+	p := aliveProxy("p")
+	p.reportFailure()
+	p.reportHealth(true, 1, 1)
+	if p.alive.Load() {
+		t.Fatal("health check revived a proxy with an open circuit")
+	}
+	p.reportHealth(false, 1, 1)
+	if p.tryProbe() {
+		t.Fatal("probe allowed while the health check fails")
+	}
+	p.reportHealth(true, 1, 1)
+	if !p.tryProbe() {
+		t.Fatal("probe not allowed once the health check passes")
+	}
+	p.reportSuccess()
+	if !p.alive.Load() {
+		t.Fatal("successful probe did not revive the proxy")
+	}
+}
+
+func TestValidateCircuitBreaker(t *testing.T) {
+	for _, cb := range []*CircuitBreaker{{Failures: -1}, {ErrorRate: 1.5}, {MinRequests: -1}, {Window: -time.Second}, {OpenTimeout: -time.Second}} {
+		if err := validateCircuitBreaker(cb); err == nil {
+			t.Fatalf("expected error for %+v", cb)
+		}
+	}
+}
+
+// startFakeHop starts a server that answers each connection with serve.
+func startFakeHop(t *testing.T, serve func(c net.Conn)) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				serve(c)
+			}()
+		}
+	}()
+	return ln
+}
+
+// socks5Replier answers every SOCKS5 request with rep.
+func socks5Replier(rep byte) func(net.Conn) {
+	return func(c net.Conn) {
+		buf := make([]byte, 10)
+		if _, err := io.ReadFull(c, buf[:3]); err != nil {
+			return
+		}
+		c.Write([]byte{0x05, 0x00})
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return
+		}
+		c.Write([]byte{0x05, rep, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	}
+}
+
+// httpReplier answers every CONNECT with status.
+func httpReplier(status string) func(net.Conn) {
+	return func(c net.Conn) {
+		br := bufio.NewReader(c)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if line == "\r\n" {
+				break
+			}
+		}
+		c.Write([]byte("HTTP/1.1 " + status + "\r\n\r\n"))
+	}
+}
+
+// socks4Replier answers every SOCKS4 request without a user ID with code.
+func socks4Replier(code byte) func(net.Conn) {
+	return func(c net.Conn) {
+		buf := make([]byte, 9)
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return
+		}
+		c.Write([]byte{0x00, code, 0, 0, 0, 0, 0, 0})
+	}
+}
+
+func TestBreakerIgnoresTargetRefusal(t *testing.T) {
+	withBreakerSettings(t, CircuitBreaker{Failures: 1})
+	for _, tt := range []struct {
+		name  string
+		typ   string
+		serve func(net.Conn)
+		open  bool
+	}{
+		{"socks5 refused", "socks5", socks5Replier(0x05), false},
+		{"socks5 host unreachable", "socks5", socks5Replier(0x04), false},
+		{"socks5 general failure", "socks5", socks5Replier(0x01), true},
+		{"http bad gateway", "http", httpReplier("502 Bad Gateway"), false},
+		{"http gateway timeout", "http", httpReplier("504 Gateway Timeout"), false},
+		{"http server error", "http", httpReplier("500 Internal Server Error"), true},
+		{"socks4 rejected", "socks4", socks4Replier(0x5B), false},
+		{"socks4 identd", "socks4", socks4Replier(0x5C), true},
+	} {
+		ln := startFakeHop(t, tt.serve)
+		defer ln.Close()
+		p := &Proxy{Name: "p", Type: tt.typ, Host: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port}
+		p.alive.Store(true)
+		if _, _, err := requestThrough(t.Context(), []*Proxy{p}, 0x01, "127.0.0.1", 80); err == nil {
+			t.Fatalf("%s: expected error", tt.name)
+		}
+		if open := !p.alive.Load(); open != tt.open {
+			t.Errorf("%s: circuit open = %v, want %v", tt.name, open, tt.open)
+		}
+	}
+}
+
+func TestBreakerIgnoresResolveFailure(t *testing.T) {
+	withBreakerSettings(t, CircuitBreaker{Failures: 1})
+	ln := startFakeHop(t, socks4Replier(0x5A))
+	defer ln.Close()
+	p := &Proxy{Name: "p", Type: "socks4", Host: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port}
+	p.alive.Store(true)
+	ctx, cancel := context.WithTimeout(t.Context(), 2*time.Second)
+	defer cancel()
+	if _, _, err := requestThrough(ctx, []*Proxy{p}, 0x01, "missing.invalid", 80); err == nil {
+		t.Fatal("expected the lookup to fail")
+	}
+	if !p.alive.Load() {
+		t.Fatal("a failed lookup of the destination opened the circuit")
+	}
+}
+
+func TestBreakerBlamesUnreachableNextHop(t *testing.T) {
+	withBreakerSettings(t, CircuitBreaker{Failures: 1})
+	ln := startFakeHop(t, socks5Replier(0x05))
+	defer ln.Close()
+	first := &Proxy{Name: "first", Host: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port}
+	next := &Proxy{Name: "next", Host: "10.0.0.1", Port: 1080}
+	first.alive.Store(true)
+	next.alive.Store(true)
+	if _, _, err := requestThrough(t.Context(), []*Proxy{first, next}, 0x01, "127.0.0.1", 80); err == nil {
+		t.Fatal("expected error")
+	}
+	if !first.alive.Load() {
+		t.Fatal("the hop that reported the refusal was blamed")
+	}
+	if next.alive.Load() {
+		t.Fatal("the unreachable next hop was not blamed")
+	}
+}
+
+func TestBreakerProbeLeadsHop(t *testing.T) {
+	withBreakerSettings(t, CircuitBreaker{Failures: 1, OpenTimeout: 10 * time.Millisecond})
+	p1 := &Proxy{Name: "p1", Host: "h1", Port: 1, Priority: 1}
+	p2 := &Proxy{Name: "p2", Host: "h2", Port: 2, Priority: 2}
+	p3 := &Proxy{Name: "p3", Host: "h3", Port: 3, Priority: 3}
+	cfg := Config{Chains: []UserChain{{Chain: []*Hop{{Strategy: "priority", Proxies: []*Proxy{p1, p2, p3}}}}}}
+	initProxies(&cfg)
+	hop := cfg.Chains[0].Chain[0]
+
+	p1.reportFailure()
+	if res := hop.orderedProxies(dialInfo{}); len(res) != 2 {
+		t.Fatalf("open proxy listed before open_timeout: %v", res)
+	}
+	time.Sleep(20 * time.Millisecond)
+	res := hop.orderedProxies(dialInfo{})
+	if len(res) != 3 || res[0] != p1 || res[1] != p3 || res[2] != p2 {
+		t.Fatalf("probing proxy should lead the hop, got %v", res)
+	}
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -15,43 +18,88 @@ import (
 )
 
 type cachedChain struct {
+	key      string
 	combo    []*Proxy
+	created  time.Time
 	lastUsed time.Time
+	hits     int
+	ttl      time.Duration // sessions only
 }
 
 type ChainState struct {
-	chain    []*Hop
-	password string
-	cacheMu  sync.RWMutex
-	cache    *cachedChain
-	refs     int32
+	name      string
+	chain     []*Hop
+	password  string
+	cacheOnce sync.Once
+	cache     *chainCache
+	sessions  *chainCache
+	refs      int32
 }
 
 func (cs *ChainState) acquire() { atomic.AddInt32(&cs.refs, 1) }
 
 func (cs *ChainState) release() { atomic.AddInt32(&cs.refs, -1) }
 
+// usesStrategy reports whether any hop of the chain uses strategy.
+func (cs *ChainState) usesStrategy(strategy string) bool {
+	for _, h := range cs.chain {
+		if strings.EqualFold(h.Strategy, strategy) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cs *ChainState) initCaches() {
+	cs.cacheOnce.Do(func() {
+		if cs.cache == nil {
+			cs.cache = newChainCache(chainCacheSize, chainCacheTTL)
+		}
+		if cs.sessions == nil {
+			cs.sessions = newChainCache(chainCacheSize, 0)
+		}
+	})
+}
+
+// destCache returns the user's per-destination chain cache.
+func (cs *ChainState) destCache() *chainCache {
+	cs.initCaches()
+	return cs.cache
+}
+
+// sessionCache returns the combos pinned to the user's sessions. Each
+// entry carries the session's TTL.
+func (cs *ChainState) sessionCache() *chainCache {
+	cs.initCaches()
+	return cs.sessions
+}
+
 func (cs *ChainState) clearCache() {
-	cs.cacheMu.Lock()
-	cs.cache = nil
-	cs.cacheMu.Unlock()
+	cs.destCache().clear()
+	cs.sessionCache().clear()
 }
 
-func (h *Hop) orderedProxies() []*Proxy {
-	var proxies []*Proxy
+func (h *Hop) orderedProxies(info dialInfo) []*Proxy {
+	var proxies, probes []*Proxy
 	if len(h.Proxies) > 0 {
 		for _, p := range h.Proxies {
-			if p.alive.Load() {
+			switch {
+			case p.alive.Load():
 				proxies = append(proxies, p)
+			case p.tryProbe():
+				proxies = append(proxies, p)
+				probes = append(probes, p)
 			}
 		}
 	} else if h.Host != "" {
 		p := &Proxy{
 			Name:     h.Name,
+			Type:     h.Type,
 			Username: h.Username,
 			Password: h.Password,
 			Host:     h.Host,
 			Port:     h.Port,
+			TLS:      h.TLS,
 		}
 		p.alive.Store(true)
 		proxies = []*Proxy{p}
@@ -68,7 +116,7 @@ func (h *Hop) orderedProxies() []*Proxy {
 		groups := make(map[int][]*Proxy)
 		var priorities []int
 		for _, p := range proxies {
-			pr := p.Priority
+			pr := h.member(p).priority
 			if _, ok := groups[pr]; !ok {
 				priorities = append(priorities, pr)
 			}
@@ -88,83 +136,218 @@ func (h *Hop) orderedProxies() []*Proxy {
 			ordered = append(ordered, grp...)
 		}
 		proxies = ordered
+	case "latency":
+		proxies = orderByLatency(proxies)
+	case "weighted":
+		proxies = h.orderWeighted(proxies)
+	case "hash":
+		proxies = h.orderByHash(proxies, h.hashKey(info))
+	case "least_conn":
+		idx := atomic.AddUint32(&h.rrCount, 1) - 1
+		start := int(idx % uint32(len(proxies)))
+		proxies = append(proxies[start:], proxies[:start]...)
+		sort.SliceStable(proxies, func(i, j int) bool {
+			return proxies[i].active.Load() < proxies[j].active.Load()
+		})
 	default:
 		idx := atomic.AddUint32(&h.rrCount, 1) - 1
 		start := int(idx % uint32(len(proxies)))
 		proxies = append(proxies[start:], proxies[:start]...)
 	}
-	return proxies
+	proxies = applySlowStart(proxies)
+	if len(probes) > 0 {
+		// A probe only tells whether the circuit can close if it is
+		// actually used, so it goes ahead of the proxies that work.
+		proxies = slices.DeleteFunc(proxies, func(p *Proxy) bool { return slices.Contains(probes, p) })
+		proxies = append(probes, proxies...)
+	}
+	return h.preferTagged(proxies, info)
 }
 
 func dialChain(ctx context.Context, state *ChainState, finalHost string, finalPort int) (net.Conn, error) {
-	state.cacheMu.RLock()
-	cached := state.cache
-	state.cacheMu.RUnlock()
+	conn, _, err := requestChain(ctx, state, 0x01, finalHost, finalPort)
+	return conn, err
+}
+
+// requestChain builds a connection through the user's chain and issues cmd
+// on the last hop. It returns the address bound by the last hop.
+func requestChain(ctx context.Context, state *ChainState, cmd byte, finalHost string, finalPort int) (net.Conn, boundAddr, error) {
+	if chainDialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, chainDialTimeout)
+		defer cancel()
+	}
+	sess := sessionFromContext(ctx)
+	// A hash hop already keeps its selection stable, by its own key, and
+	// group or country preferences must not be masked by a cached chain.
+	cacheable := !state.usesStrategy("hash") && sess.group == "" && sess.country == ""
+	key := chainCacheKey(cmd, finalHost)
+	var cached *cachedChain
+	switch {
+	case sess.id != "":
+		cached = state.sessionCache().get(sess.id)
+	case cacheable:
+		cached = state.destCache().get(key)
+	}
 	if cached != nil {
-		if conn, err := connectThrough(ctx, cached.combo, finalHost, finalPort); err == nil {
-			state.cacheMu.Lock()
-			cached.lastUsed = time.Now()
-			state.cacheMu.Unlock()
-			return conn, nil
+		if conn, bnd, err := requestThrough(ctx, cached.combo, cmd, finalHost, finalPort); err == nil {
+			return &chainConn{Conn: conn, combo: cached.combo}, bnd, nil
+		}
+		if sess.id != "" {
+			state.sessionCache().fail(sess.id)
+		} else {
+			state.destCache().fail(key)
 		}
-		state.cacheMu.Lock()
-		state.cache = nil
-		state.cacheMu.Unlock()
 	}
 	chain := state.chain
 	current := make([]*Proxy, len(chain))
-	conn, err := dialChainRecursive(ctx, chain, 0, current, finalHost, finalPort)
+	info := dialInfo{
+		host:    finalHost,
+		client:  clientIPFromContext(ctx),
+		user:    state.name,
+		group:   sess.group,
+		country: sess.country,
+	}
+	att := newChainAttempts()
+	var conn net.Conn
+	var bnd boundAddr
+	var err error
+	if raceDelay > 0 {
+		conn, bnd, err = raceChain(ctx, chain, current, info, att, cmd, finalHost, finalPort)
+	} else {
+		conn, bnd, err = dialChainRecursive(ctx, chain, 0, current, info, att, cmd, finalHost, finalPort)
+	}
 	if err == nil {
 		combo := append([]*Proxy(nil), current...)
-		state.cacheMu.Lock()
-		state.cache = &cachedChain{combo: combo, lastUsed: time.Now()}
-		state.cacheMu.Unlock()
+		switch {
+		case sess.id != "":
+			state.sessionCache().putTTL(sess.id, combo, sess.ttl)
+		case cacheable:
+			state.destCache().put(key, combo)
+		}
+		conn = &chainConn{Conn: conn, combo: combo}
 	}
-	return conn, err
+	return conn, bnd, err
 }
 
 func connectThrough(ctx context.Context, combo []*Proxy, finalHost string, finalPort int) (net.Conn, error) {
+	conn, _, err := requestThrough(ctx, combo, 0x01, finalHost, finalPort)
+	return conn, err
+}
+
+// requestThrough tunnels through every hop of combo with CONNECT and sends
+// cmd to the last one.
+func requestThrough(ctx context.Context, combo []*Proxy, cmd byte, finalHost string, finalPort int) (net.Conn, boundAddr, error) {
 	var conn net.Conn
+	var bnd boundAddr
 	var err error
 	for i := range combo {
 		nextHost := finalHost
 		nextPort := finalPort
+		hopCmd := cmd
 		if i+1 < len(combo) {
 			next := combo[i+1]
 			nextHost = next.Host
 			nextPort = next.Port
+			hopCmd = 0x01
 		}
-		conn, err = connectProxy(ctx, conn, combo[i], nextHost, nextPort, ioTimeout)
+		// Handshakes use deadlines rather than ctx, so keep them within it.
+		timeout := ioTimeout
+		if dl, ok := ctx.Deadline(); ok && time.Until(dl) < timeout {
+			timeout = time.Until(dl)
+		}
+		if timeout <= 0 {
+			if conn != nil {
+				conn.Close()
+			}
+			return nil, boundAddr{}, &hopError{index: i, proxy: combo[i].Name, err: context.DeadlineExceeded}
+		}
+		start := time.Now()
+		conn, bnd, err = requestProxy(ctx, conn, combo[i], hopCmd, nextHost, nextPort, timeout)
 		if err != nil {
-			combo[i].alive.Store(false)
-			return nil, fmt.Errorf("hop %s: %w", combo[i].Name, err)
+			switch {
+			case context.Cause(ctx) == errRaceLost:
+			case proxyFault(err):
+				combo[i].reportFailure()
+			default:
+				// The proxy works; what it was asked to reach does not.
+				// When that is the next proxy, only real traffic through
+				// this hop can tell, so it is blamed here.
+				combo[i].reportSuccess()
+				if i+1 < len(combo) && unreachable(err) {
+					combo[i+1].reportFailure()
+				}
+			}
+			return nil, boundAddr{}, &hopError{index: i, proxy: combo[i].Name, target: !proxyFault(err), err: err}
 		}
+		combo[i].reportSuccess()
+		combo[i].observeLatency(time.Since(start))
 		debugLog.Printf("connected to hop %s targeting %s:%d", combo[i].Name, nextHost, nextPort)
 	}
-	return conn, nil
+	return conn, bnd, nil
 }
 
-func dialChainRecursive(ctx context.Context, chain []*Hop, depth int, current []*Proxy, finalHost string, finalPort int) (net.Conn, error) {
+// chainConn is a connection through the proxies of combo. proxy() counts
+// it as active on each of them while relaying.
+type chainConn struct {
+	net.Conn
+	combo []*Proxy
+}
+
+// dialChainRecursive tries the combos of chain one at a time until one
+// connects, att runs out or ctx is done. Combos sharing a prefix that
+// already failed are skipped.
+func dialChainRecursive(ctx context.Context, chain []*Hop, depth int, current []*Proxy, info dialInfo, att *chainAttempts, cmd byte, finalHost string, finalPort int) (net.Conn, boundAddr, error) {
 	if depth == len(chain) {
-		return connectThrough(ctx, current, finalHost, finalPort)
+		att.started++
+		conn, bnd, err := requestThrough(ctx, current, cmd, finalHost, finalPort)
+		if err != nil {
+			att.record(current, err)
+		}
+		return conn, bnd, err
 	}
-	proxies := chain[depth].orderedProxies()
-	var lastErr error
-	for _, p := range proxies {
+	for _, p := range chain[depth].orderedProxies(info) {
+		if att.exhausted() || ctx.Err() != nil || att.blocked(current[:depth]) {
+			break
+		}
 		current[depth] = p
-		conn, err := dialChainRecursive(ctx, chain, depth+1, current, finalHost, finalPort)
-		if err == nil {
-			return conn, nil
+		if att.blocked(current[:depth+1]) {
+			continue
+		}
+		if conn, bnd, err := dialChainRecursive(ctx, chain, depth+1, current, info, att, cmd, finalHost, finalPort); err == nil {
+			return conn, bnd, nil
 		}
-		lastErr = err
 	}
-	if lastErr != nil {
-		return nil, lastErr
+	return nil, boundAddr{}, att.err()
+}
+
+// boundAddr is the BND.ADDR and BND.PORT pair from a SOCKS5 reply.
+type boundAddr struct {
+	host string
+	port int
+}
+
+func cmdName(cmd byte) string {
+	switch cmd {
+	case 0x01:
+		return "connect"
+	case 0x02:
+		return "bind"
+	case 0x03:
+		return "udp associate"
 	}
-	return nil, fmt.Errorf("no valid proxy chain")
+	return fmt.Sprintf("command 0x%02X", cmd)
 }
 
 func connectProxy(ctx context.Context, prev net.Conn, hop *Proxy, host string, port int, timeout time.Duration) (net.Conn, error) {
+	conn, _, err := requestProxy(ctx, prev, hop, 0x01, host, port, timeout)
+	return conn, err
+}
+
+// dialHop opens a connection to hop, directly or through prev, and
+// completes the TLS handshake when the hop uses TLS. The connection is
+// closed on failure.
+func dialHop(ctx context.Context, prev net.Conn, hop *Proxy, timeout time.Duration) (net.Conn, error) {
 	addr := net.JoinHostPort(hop.Host, strconv.Itoa(hop.Port))
 	var conn net.Conn
 	var err error
@@ -186,104 +369,188 @@ func connectProxy(ctx context.Context, prev net.Conn, hop *Proxy, host string, p
 	} else {
 		conn = prev
 	}
-	buf := make([]byte, 512)
-	methods := []byte{0x00}
-	wantAuth := hop.Username != "" || hop.Password != ""
-	if wantAuth {
-		methods = append(methods, 0x02)
-	}
-	req := append([]byte{0x05, byte(len(methods))}, methods...)
-	conn.SetDeadline(time.Now().Add(timeout))
-	if err := writeFull(conn, req); err != nil {
+	tlsConf, err := hop.clientTLS()
+	if err != nil {
 		conn.Close()
-		return nil, err
+		return nil, fmt.Errorf("hop %s: %w", hop.Name, err)
 	}
-	conn.SetDeadline(time.Now().Add(timeout))
-	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
-		conn.Close()
-		return nil, err
+	if tlsConf != nil {
+		tc := tls.Client(conn, tlsConf)
+		hctx, cancel := context.WithTimeout(ctx, timeout)
+		err := tc.HandshakeContext(hctx)
+		cancel()
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("tls handshake with hop %s: %w", hop.Name, err)
+		}
+		debugLog.Printf("hop %s tls established", hop.Name)
+		conn = tc
 	}
-	if buf[0] != 0x05 {
-		conn.Close()
-		return nil, fmt.Errorf("bad method response")
+	return conn, nil
+}
+
+func requestProxy(ctx context.Context, prev net.Conn, hop *Proxy, cmd byte, host string, port int, timeout time.Duration) (net.Conn, boundAddr, error) {
+	conn, err := dialHop(ctx, prev, hop, timeout)
+	if err != nil {
+		return nil, boundAddr{}, err
 	}
-	method := buf[1]
-	if method == 0x02 {
-		u := []byte(hop.Username)
-		p := []byte(hop.Password)
-		if len(u) > 255 || len(p) > 255 {
+	switch strings.ToLower(hop.Type) {
+	case "http":
+		if cmd != 0x01 {
 			conn.Close()
-			return nil, fmt.Errorf("hop %s: username/password too long", hop.Name)
+			return nil, boundAddr{}, fmt.Errorf("%s not supported by http hop %s", cmdName(cmd), hop.Name)
 		}
-		req := []byte{0x01, byte(len(u))}
-		req = append(req, u...)
-		req = append(req, byte(len(p)))
-		req = append(req, p...)
-		conn.SetDeadline(time.Now().Add(timeout))
-		if err := writeFull(conn, req); err != nil {
-			conn.Close()
-			return nil, err
+		conn, err = httpConnectHop(conn, hop, host, port, timeout)
+		if err != nil {
+			return nil, boundAddr{}, err
 		}
-		conn.SetDeadline(time.Now().Add(timeout))
-		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		debugLog.Printf("hop %s connection established", hop.Name)
+		return conn, boundAddr{}, nil
+	case "socks4", "socks4a":
+		if cmd != 0x01 {
 			conn.Close()
-			return nil, err
+			return nil, boundAddr{}, fmt.Errorf("%s not supported by socks4 hop %s", cmdName(cmd), hop.Name)
 		}
-		if buf[1] != 0x00 {
+		remoteDNS := strings.ToLower(hop.Type) == "socks4a"
+		if err := socks4ConnectHop(ctx, conn, hop, host, port, remoteDNS, timeout); err != nil {
 			conn.Close()
-			return nil, fmt.Errorf("auth failed for hop %s", hop.Name)
+			return nil, boundAddr{}, err
 		}
-	} else if method != 0x00 {
+		conn.SetDeadline(time.Time{})
+		debugLog.Printf("hop %s connection established", hop.Name)
+		return conn, boundAddr{}, nil
+	}
+	return socks5Request(conn, hop, cmd, host, port, timeout)
+}
+
+// socks5Request negotiates with a SOCKS5 hop over conn and sends cmd. conn
+// is closed on failure.
+func socks5Request(conn net.Conn, hop *Proxy, cmd byte, host string, port int, timeout time.Duration) (net.Conn, boundAddr, error) {
+	if err := socks5Auth(conn, hop, timeout); err != nil {
 		conn.Close()
-		return nil, fmt.Errorf("bad method response")
+		return nil, boundAddr{}, err
 	}
 	atyp, addrBytes, err := encodeAddr(host)
 	if err != nil {
 		conn.Close()
-		return nil, err
+		return nil, boundAddr{}, err
 	}
-	req = []byte{0x05, 0x01, 0x00, atyp}
+	req := []byte{0x05, cmd, 0x00, atyp}
 	req = append(req, addrBytes...)
 	req = append(req, byte(port>>8), byte(port))
 	conn.SetDeadline(time.Now().Add(timeout))
 	if err := writeFull(conn, req); err != nil {
 		conn.Close()
-		return nil, err
+		return nil, boundAddr{}, err
 	}
-	conn.SetDeadline(time.Now().Add(timeout))
-	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+	rep, bnd, err := readReply(conn, timeout)
+	if err != nil {
 		conn.Close()
-		return nil, err
+		return nil, boundAddr{}, err
 	}
-	if buf[1] != 0x00 {
+	if rep != 0x00 {
 		conn.Close()
-		return nil, fmt.Errorf("connect failed on hop %s", hop.Name)
+		return nil, boundAddr{}, &replyError{cmd: cmd, hop: hop.Name, rep: rep}
 	}
-	var skip int
+	if cmd != 0x01 {
+		// An unspecified bound address means "the address of the proxy itself".
+		if ip := net.ParseIP(bnd.host); ip != nil && ip.IsUnspecified() {
+			bnd.host = hop.Host
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	debugLog.Printf("hop %s connection established", hop.Name)
+	return conn, bnd, nil
+}
+
+// replyError is a failure reply from a SOCKS5 hop.
+type replyError struct {
+	cmd byte
+	hop string
+	rep byte
+}
+
+func (e *replyError) Error() string {
+	return fmt.Sprintf("%s failed on hop %s: code 0x%02X", cmdName(e.cmd), e.hop, e.rep)
+}
+
+// targetError is an HTTP or SOCKS4 hop failing to reach its target, or
+// the target's name failing to resolve.
+type targetError struct {
+	err error
+}
+
+func (e *targetError) Error() string { return e.err.Error() }
+
+func (e *targetError) Unwrap() error { return e.err }
+
+// proxyFault reports whether err is the proxy's own fault rather than its
+// target refusing or being unreachable. Of the SOCKS5 failure replies only
+// the general failure blames the proxy.
+func proxyFault(err error) bool {
+	var re *replyError
+	if errors.As(err, &re) {
+		return re.rep == 0x01
+	}
+	var te *targetError
+	return !errors.As(err, &te)
+}
+
+// unreachable reports whether err is a hop saying that its target could
+// not be reached, rather than refusing the request by its own rules.
+func unreachable(err error) bool {
+	var re *replyError
+	if errors.As(err, &re) {
+		return re.rep >= 0x03 && re.rep <= 0x06
+	}
+	var te *targetError
+	return errors.As(err, &te)
+}
+
+// readReply reads a SOCKS5 reply and returns its REP field and bound address.
+func readReply(conn net.Conn, timeout time.Duration) (byte, boundAddr, error) {
+	buf := make([]byte, 256)
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return 0, boundAddr{}, err
+	}
+	if buf[0] != 0x05 {
+		return 0, boundAddr{}, fmt.Errorf("bad reply version %d", buf[0])
+	}
+	rep := buf[1]
+	var host string
 	switch buf[3] {
 	case 0x01:
-		skip = 4
+		conn.SetDeadline(time.Now().Add(timeout))
+		if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+			return 0, boundAddr{}, err
+		}
+		host = net.IP(buf[:4]).String()
 	case 0x03:
 		conn.SetDeadline(time.Now().Add(timeout))
 		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
-			conn.Close()
-			return nil, err
+			return 0, boundAddr{}, err
+		}
+		dlen := int(buf[0])
+		conn.SetDeadline(time.Now().Add(timeout))
+		if _, err := io.ReadFull(conn, buf[:dlen]); err != nil {
+			return 0, boundAddr{}, err
 		}
-		skip = int(buf[0])
+		host = string(buf[:dlen])
 	case 0x04:
-		skip = 16
+		conn.SetDeadline(time.Now().Add(timeout))
+		if _, err := io.ReadFull(conn, buf[:16]); err != nil {
+			return 0, boundAddr{}, err
+		}
+		host = net.IP(buf[:16]).String()
 	default:
-		conn.Close()
-		return nil, fmt.Errorf("bad atyp %d", buf[3])
+		return 0, boundAddr{}, fmt.Errorf("bad atyp %d", buf[3])
 	}
 	conn.SetDeadline(time.Now().Add(timeout))
-	if _, err := io.ReadFull(conn, buf[:skip+2]); err != nil {
-		conn.Close()
-		return nil, err
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return 0, boundAddr{}, err
 	}
-	conn.SetDeadline(time.Time{})
-	debugLog.Printf("hop %s connection established", hop.Name)
-	return conn, nil
+	return rep, boundAddr{host: host, port: int(buf[0])<<8 | int(buf[1])}, nil
 }
 
 func startChainCacheCleanup(ctx context.Context, ttl time.Duration) {
@@ -297,13 +564,18 @@ func startChainCacheCleanup(ctx context.Context, ttl time.Duration) {
 			select {
 			case <-ticker.C:
 				now := time.Now()
-				chains := userChains.Load().(map[string]*ChainState)
-				for _, st := range chains {
-					st.cacheMu.Lock()
-					if st.cache != nil && now.Sub(st.cache.lastUsed) > ttl {
-						st.cache = nil
+				var states []*ChainState
+				for _, st := range userChains.Load().(map[string]*ChainState) {
+					states = append(states, st)
+				}
+				if rt := routes.Load(); rt != nil {
+					for _, st := range rt.chains {
+						states = append(states, st)
 					}
-					st.cacheMu.Unlock()
+				}
+				for _, st := range states {
+					st.destCache().expire(now, ttl)
+					st.sessionCache().expire(now, ttl)
 				}
 			case <-ctx.Done():
 				return
@@ -312,6 +584,55 @@ func startChainCacheCleanup(ctx context.Context, ttl time.Duration) {
 	}()
 }
 
+// socks5Auth performs the SOCKS5 method negotiation with hop over conn,
+// authenticating with the hop's credentials when it asks for them.
+func socks5Auth(conn net.Conn, hop *Proxy, timeout time.Duration) error {
+	buf := make([]byte, 512)
+	methods := []byte{0x00}
+	wantAuth := hop.Username != "" || hop.Password != ""
+	if wantAuth {
+		methods = append(methods, 0x02)
+	}
+	req := append([]byte{0x05, byte(len(methods))}, methods...)
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := writeFull(conn, req); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != 0x05 {
+		return fmt.Errorf("bad method response")
+	}
+	method := buf[1]
+	if method == 0x02 {
+		u := []byte(hop.Username)
+		p := []byte(hop.Password)
+		if len(u) > 255 || len(p) > 255 {
+			return fmt.Errorf("hop %s: username/password too long", hop.Name)
+		}
+		req := []byte{0x01, byte(len(u))}
+		req = append(req, u...)
+		req = append(req, byte(len(p)))
+		req = append(req, p...)
+		conn.SetDeadline(time.Now().Add(timeout))
+		if err := writeFull(conn, req); err != nil {
+			return err
+		}
+		conn.SetDeadline(time.Now().Add(timeout))
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return err
+		}
+		if buf[1] != 0x00 {
+			return fmt.Errorf("auth failed for hop %s", hop.Name)
+		}
+	} else if method != 0x00 {
+		return fmt.Errorf("bad method response")
+	}
+	return nil
+}
+
 func encodeAddr(host string) (byte, []byte, error) {
 	if ip := net.ParseIP(host); ip != nil {
 		if ip4 := ip.To4(); ip4 != nil {
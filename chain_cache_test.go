@@ -1,32 +1,117 @@
 package main
 
 import (
-    "context"
-    "testing"
-    "time"
+	"context"
+	"testing"
+	"time"
 )
 
+func aliveProxy(name string) *Proxy {
+	p := &Proxy{Name: name}
+	p.alive.Store(true)
+	return p
+}
+
 func TestStartChainCacheCleanup(t *testing.T) {
-    ttl := 10 * time.Millisecond
-    cs := &ChainState{cache: &cachedChain{combo: []*Proxy{{}}, lastUsed: time.Now().Add(-2 * ttl)}}
-    userChains.Store(map[string]*ChainState{"u": cs})
-    defer userChains.Store(map[string]*ChainState{})
-
-    ctx, cancel := context.WithCancel(context.Background())
-    defer cancel()
-
-    startChainCacheCleanup(ctx, ttl)
-
-    // Wait until cache is cleared or timeout
-    for i := 0; i < 10; i++ {
-        cs.cacheMu.RLock()
-        cleared := cs.cache == nil
-        cs.cacheMu.RUnlock()
-        if cleared {
-            return
-        }
-        time.Sleep(ttl)
-    }
-    t.Fatal("cache was not cleaned")
+	origDebug := debugLog
+	debugLog = nopLogger{}
+	defer func() { debugLog = origDebug }()
+
+	ttl := 10 * time.Millisecond
+	cs := &ChainState{}
+	cs.destCache().put("example.com", []*Proxy{aliveProxy("a")})
+	cs.cache.order.Front().Value.(*cachedChain).lastUsed = time.Now().Add(-2 * ttl)
+	userChains.Store(map[string]*ChainState{"u": cs})
+	defer userChains.Store(map[string]*ChainState{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	startChainCacheCleanup(ctx, ttl)
+
+	// Wait until cache is cleared or timeout
+	for i := 0; i < 10; i++ {
+		if cs.destCache().len() == 0 {
+			return
+		}
+		time.Sleep(ttl)
+	}
+	t.Fatal("cache was not cleaned")
+}
+
+func TestChainCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	origDebug := debugLog
+	debugLog = nopLogger{}
+	defer func() { debugLog = origDebug }()
+
+	c := newChainCache(2, 0)
+	a, b := aliveProxy("a"), aliveProxy("b")
+	c.put("one.example", []*Proxy{a})
+	c.put("two.example", []*Proxy{b})
+	if c.get("one.example") == nil {
+		t.Fatal("one.example missing")
+	}
+	c.put("three.example", []*Proxy{a})
+	if c.get("two.example") != nil {
+		t.Fatal("least recently used entry was not evicted")
+	}
+	cc := c.get("one.example")
+	if cc == nil || cc.hits != 2 {
+		t.Fatalf("expected one.example with 2 hits, got %+v", cc)
+	}
+	if c.len() != 2 {
+		t.Fatalf("expected 2 entries, got %d", c.len())
+	}
+}
+
+func TestChainCacheDropsDeadProxies(t *testing.T) {
+	origDebug := debugLog
+	debugLog = nopLogger{}
+	defer func() { debugLog = origDebug }()
+
+	c := newChainCache(0, 0)
+	a, b := aliveProxy("a"), aliveProxy("b")
+	c.put("one.example", []*Proxy{a, b})
+	c.put("two.example", []*Proxy{a})
+	b.alive.Store(false)
+	if c.get("one.example") != nil {
+		t.Fatal("entry with a dead proxy was returned")
+	}
+	if c.get("two.example") == nil {
+		t.Fatal("entry with live proxies was dropped")
+	}
+	a.alive.Store(false)
+	c.expire(time.Now(), time.Hour)
+	if c.len() != 0 {
+		t.Fatalf("expected empty cache, got %d entries", c.len())
+	}
 }
 
+func TestChainCacheGetExpired(t *testing.T) {
+	origDebug := debugLog
+	debugLog = nopLogger{}
+	defer func() { debugLog = origDebug }()
+
+	c := newChainCache(0, time.Minute)
+	c.put("old.example", []*Proxy{aliveProxy("a")})
+	c.put("new.example", []*Proxy{aliveProxy("b")})
+	c.entries["old.example"].Value.(*cachedChain).lastUsed = time.Now().Add(-2 * time.Minute)
+	if c.get("old.example") != nil {
+		t.Fatal("expired entry was returned")
+	}
+	if c.len() != 1 {
+		t.Fatalf("expired entry was not evicted, %d entries", c.len())
+	}
+	if c.get("new.example") == nil {
+		t.Fatal("fresh entry was dropped")
+	}
+}
+
+func TestChainCacheKey(t *testing.T) {
+	if chainCacheKey(0x01, "Example.COM") != chainCacheKey(0x01, "example.com") {
+		t.Fatal("keys should be case-insensitive")
+	}
+	if chainCacheKey(0x01, "example.com") == chainCacheKey(0x03, "example.com") {
+		t.Fatal("connect and udp associate should not share a key")
+	}
+}
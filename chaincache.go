@@ -0,0 +1,156 @@
+package main
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultChainCacheSize = 1024
+
+var chainCacheSize = defaultChainCacheSize
+
+// chainCacheTTL is how long a cached combo may go unused, from
+// general.chain_cleanup_interval. Zero keeps entries until they are
+// evicted or fail.
+var chainCacheTTL time.Duration
+
+// chainCache remembers, per destination or per session, the combo that
+// last reached it. It holds at most size entries and evicts the least
+// recently used one.
+type chainCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List // of *cachedChain, most recently used first
+	entries map[string]*list.Element
+}
+
+func newChainCache(size int, ttl time.Duration) *chainCache {
+	return &chainCache{size: size, ttl: ttl, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// chainCacheKey groups destinations that share a cached combo. Ports are
+// ignored so that a site's HTTP and HTTPS connections leave the same way.
+func chainCacheKey(cmd byte, host string) string {
+	key := strings.ToLower(host)
+	if cmd != 0x01 {
+		key = cmdName(cmd) + " " + key
+	}
+	return key
+}
+
+// expired reports whether cc went unused for longer than its own TTL, for
+// sessions, or else ttl.
+func (cc *cachedChain) expired(now time.Time, ttl time.Duration) bool {
+	if cc.ttl > 0 {
+		ttl = cc.ttl
+	}
+	return ttl > 0 && now.Sub(cc.lastUsed) > ttl
+}
+
+// alive reports whether every proxy of the combo is still marked alive.
+func (cc *cachedChain) alive() bool {
+	for _, p := range cc.combo {
+		if !p.alive.Load() {
+			return false
+		}
+	}
+	return true
+}
+
+// get returns the combo cached for key. Entries unused for longer than the
+// TTL or with a proxy that has since been marked dead are dropped rather
+// than returned.
+func (c *chainCache) get(key string) *cachedChain {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	cc := e.Value.(*cachedChain)
+	if cc.expired(time.Now(), c.ttl) {
+		c.removeElement(e, "expired")
+		return nil
+	}
+	if !cc.alive() {
+		c.removeElement(e, "member proxy dead")
+		return nil
+	}
+	cc.hits++
+	cc.lastUsed = time.Now()
+	c.order.MoveToFront(e)
+	return cc
+}
+
+func (c *chainCache) put(key string, combo []*Proxy) {
+	c.putTTL(key, combo, 0)
+}
+
+// putTTL caches combo for key with its own idle TTL, overriding the
+// cache's.
+func (c *chainCache) putTTL(key string, combo []*Proxy, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if e, ok := c.entries[key]; ok {
+		cc := e.Value.(*cachedChain)
+		cc.combo, cc.created, cc.lastUsed, cc.ttl = combo, now, now, ttl
+		c.order.MoveToFront(e)
+		return
+	}
+	cc := &cachedChain{key: key, combo: combo, created: now, lastUsed: now, ttl: ttl}
+	c.entries[key] = c.order.PushFront(cc)
+	for c.size > 0 && c.order.Len() > c.size {
+		c.removeElement(c.order.Back(), "evicted")
+	}
+}
+
+// fail drops the entry for key after a cached combo could not reach it.
+func (c *chainCache) fail(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.removeElement(e, "connect failed")
+	}
+}
+
+// expire drops entries idle for longer than ttl, or their own TTL, and
+// entries with a dead proxy.
+func (c *chainCache) expire(now time.Time, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for e := c.order.Back(); e != nil; {
+		prev := e.Prev()
+		cc := e.Value.(*cachedChain)
+		switch {
+		case cc.expired(now, ttl):
+			c.removeElement(e, "expired")
+		case !cc.alive():
+			c.removeElement(e, "member proxy dead")
+		}
+		e = prev
+	}
+}
+
+func (c *chainCache) clear() {
+	c.mu.Lock()
+	c.order.Init()
+	c.entries = make(map[string]*list.Element)
+	c.mu.Unlock()
+}
+
+func (c *chainCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// removeElement drops e. c.mu must be held.
+func (c *chainCache) removeElement(e *list.Element, reason string) {
+	cc := c.order.Remove(e).(*cachedChain)
+	delete(c.entries, cc.key)
+	debugLog.Printf("chain cache: dropping %s (%s, %d hits, age %s)", cc.key, reason, cc.hits, time.Since(cc.created).Round(time.Second))
+}
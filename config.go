@@ -1,10 +1,12 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"os"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -17,49 +19,150 @@ const (
 	defaultHealthCheckInterval   = 30 * time.Second
 	defaultHealthCheckTimeout    = 5 * time.Second
 	defaultHealthCheckConcurrent = 10
+	defaultHealthCheckRise       = 2
+	defaultHealthCheckFall       = 3
 	defaultIOTimeout             = 5 * time.Second
 	defaultIdleTimeout           = 5 * time.Minute
 	defaultMaxConnections        = 100
+	defaultBindTimeout           = 2 * time.Minute
 )
 
 var ioTimeout = defaultIOTimeout
 var idleTimeout = defaultIdleTimeout
+var bindTimeout = defaultBindTimeout
 
 type General struct {
-	Bind                  string        `yaml:"bind"`
-	Port                  int           `yaml:"port"`
-	LogLevel              string        `yaml:"log_level"`
-	LogFormat             string        `yaml:"log_format"`
-	HealthCheckInterval   time.Duration `yaml:"health_check_interval"`
-	ChainCleanupInterval  time.Duration `yaml:"chain_cleanup_interval"`
-	HealthCheckTimeout    time.Duration `yaml:"health_check_timeout"`
-	HealthCheckConcurrent int           `yaml:"health_check_concurrency"`
-	IOTimeout             time.Duration `yaml:"io_timeout"`
-	IdleTimeout           time.Duration `yaml:"idle_timeout"`
-	ConfigReloadInterval  time.Duration `yaml:"config_reload_interval"`
-	MaxConnections        int           `yaml:"max_connections"`
+	Bind                  string          `yaml:"bind"`
+	Port                  int             `yaml:"port"`
+	LogLevel              string          `yaml:"log_level"`
+	LogFormat             string          `yaml:"log_format"`
+	HealthCheckInterval   time.Duration   `yaml:"health_check_interval"`
+	ChainCleanupInterval  time.Duration   `yaml:"chain_cleanup_interval"`
+	ChainCacheSize        int             `yaml:"chain_cache_size"`
+	RaceDelay             time.Duration   `yaml:"race_delay"`
+	RaceConcurrency       int             `yaml:"race_concurrency"`
+	ChainMaxAttempts      int             `yaml:"chain_max_attempts"`
+	ChainDialTimeout      time.Duration   `yaml:"chain_dial_timeout"`
+	CircuitBreaker        *CircuitBreaker `yaml:"circuit_breaker"`
+	HealthCheckTimeout    time.Duration   `yaml:"health_check_timeout"`
+	HealthCheckConcurrent int             `yaml:"health_check_concurrency"`
+	HealthCheckMode       string          `yaml:"health_check_mode"`
+	HealthCheckTarget     string          `yaml:"health_check_target"`
+	HealthCheckSend       string          `yaml:"health_check_send"`
+	HealthCheckExpect     string          `yaml:"health_check_expect"`
+	HealthCheckRise       int             `yaml:"health_check_rise"`
+	HealthCheckFall       int             `yaml:"health_check_fall"`
+	HealthCheckJitter     time.Duration   `yaml:"health_check_jitter"`
+	SlowStart             time.Duration   `yaml:"slow_start"`
+	GeoIPDatabase         string          `yaml:"geoip_database"`
+	ASNDatabase           string          `yaml:"asn_database"`
+	GeoIPReloadInterval   time.Duration   `yaml:"geoip_reload_interval"`
+	RulesResolve          bool            `yaml:"rules_resolve"`
+	IOTimeout             time.Duration   `yaml:"io_timeout"`
+	IdleTimeout           time.Duration   `yaml:"idle_timeout"`
+	ConfigReloadInterval  time.Duration   `yaml:"config_reload_interval"`
+	MaxConnections        int             `yaml:"max_connections"`
+	BindTimeout           time.Duration   `yaml:"bind_timeout"`
+	Socks4                bool            `yaml:"socks4"`
+	HTTPPort              int             `yaml:"http_port"`
+	TLS                   *ListenerTLS    `yaml:"tls"`
+}
+
+// Listener is one client-facing endpoint. When Config.Listeners is empty
+// a SOCKS5 listener and an optional HTTP listener are derived from the
+// legacy general.bind, general.port and general.http_port fields.
+type Listener struct {
+	Address       string         `yaml:"address"`
+	Protocol      string         `yaml:"protocol"`
+	TLS           *ListenerTLS   `yaml:"tls"`
+	Auth          string         `yaml:"auth"`
+	AllowedUsers  []string       `yaml:"allowed_users"`
+	Socks4        bool           `yaml:"socks4"`
+	Mode          string         `yaml:"mode"`
+	Owner         string         `yaml:"owner"`
+	ProxyProtocol *ProxyProtocol `yaml:"proxy_protocol"`
+	SourceUsers   []SourceUser   `yaml:"source_users"`
+}
+
+// SourceUser maps clients of a transparent listener to a user by address.
+type SourceUser struct {
+	CIDR string `yaml:"cidr"`
+	User string `yaml:"user"`
+}
+
+// ProxyProtocol makes a listener read a PROXY protocol v1 or v2 header
+// from connections whose source is in Trusted.
+type ProxyProtocol struct {
+	Enabled bool     `yaml:"enabled"`
+	Trusted []string `yaml:"trusted"`
+}
+
+// ListenerTLS enables TLS on a client-facing listener. With client
+// certificates the certificate can stand in for username/password auth.
+type ListenerTLS struct {
+	Enabled      bool   `yaml:"enabled"`
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientCAFile string `yaml:"client_ca_file"`
+	ClientAuth   string `yaml:"client_auth"`
+	CertUser     string `yaml:"cert_user"`
 }
 
 type Proxy struct {
-	Name     string      `yaml:"name"`
-	Username string      `yaml:"username"`
-	Password string      `yaml:"password"`
-	Host     string      `yaml:"host"`
-	Port     int         `yaml:"port"`
-	Priority int         `yaml:"priority"`
-	alive    atomic.Bool `yaml:"-"`
+	Name      string      `yaml:"name"`
+	Type      string      `yaml:"type"`
+	Username  string      `yaml:"username"`
+	Password  string      `yaml:"password"`
+	Host      string      `yaml:"host"`
+	Port      int         `yaml:"port"`
+	Priority  int         `yaml:"priority"`
+	Weight    int         `yaml:"weight"`
+	Group     string      `yaml:"group"`
+	Country   string      `yaml:"country"`
+	TLS       *ProxyTLS   `yaml:"tls"`
+	alive     atomic.Bool `yaml:"-"`
+	tlsConfig *tls.Config `yaml:"-"`
+	// latency is the moving average connect time in nanoseconds, or 0
+	// while unmeasured.
+	latency atomic.Int64 `yaml:"-"`
+	// active counts connections currently relayed through the proxy.
+	active  atomic.Int32 `yaml:"-"`
+	breaker breaker      `yaml:"-"`
+	// recoveredAt is when the proxy last came back into rotation, in
+	// Unix nanoseconds, for slow start.
+	recoveredAt atomic.Int64 `yaml:"-"`
+}
+
+// ProxyTLS wraps the connection to an upstream proxy in TLS before the
+// proxy protocol is spoken.
+type ProxyTLS struct {
+	Enabled            bool   `yaml:"enabled"`
+	ServerName         string `yaml:"server_name"`
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	PinSHA256          string `yaml:"pin_sha256"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
 }
 
 type Hop struct {
 	Strategy   string          `yaml:"strategy"`
+	HashKey    string          `yaml:"hash_key"`
 	Proxies    []*Proxy        `yaml:"proxies"`
+	Pool       string          `yaml:"pool"`
 	Name       string          `yaml:"name"`
+	Type       string          `yaml:"type"`
 	Username   string          `yaml:"username"`
 	Password   string          `yaml:"password"`
 	Host       string          `yaml:"host"`
 	Port       int             `yaml:"port"`
+	TLS        *ProxyTLS       `yaml:"tls"`
 	rrCount    uint32          `yaml:"-"`
 	priorityRR map[int]*uint32 `yaml:"-"`
+	wrrMu      sync.Mutex      `yaml:"-"`
+	wrrCurrent map[*Proxy]int  `yaml:"-"`
+	// members holds the per-hop settings of Proxies, see hopMember.
+	members map[*Proxy]hopMember `yaml:"-"`
 }
 
 type UserChain struct {
@@ -69,8 +172,13 @@ type UserChain struct {
 }
 
 type Config struct {
-	General General     `yaml:"general"`
-	Chains  []UserChain `yaml:"chains"`
+	General     General      `yaml:"general"`
+	Listeners   []*Listener  `yaml:"listeners"`
+	Proxies     []*Proxy     `yaml:"proxies"`
+	Pools       []Pool       `yaml:"pools"`
+	Chains      []UserChain  `yaml:"chains"`
+	NamedChains []NamedChain `yaml:"named_chains"`
+	Rules       []*Rule      `yaml:"rules"`
 }
 
 func loadConfig(path string) (Config, error) {
@@ -100,6 +208,12 @@ func loadConfig(path string) (Config, error) {
 	if cfg.General.HealthCheckConcurrent <= 0 {
 		cfg.General.HealthCheckConcurrent = defaultHealthCheckConcurrent
 	}
+	if cfg.General.HealthCheckRise == 0 {
+		cfg.General.HealthCheckRise = defaultHealthCheckRise
+	}
+	if cfg.General.HealthCheckFall == 0 {
+		cfg.General.HealthCheckFall = defaultHealthCheckFall
+	}
 	if cfg.General.IOTimeout == 0 {
 		cfg.General.IOTimeout = defaultIOTimeout
 	}
@@ -109,6 +223,21 @@ func loadConfig(path string) (Config, error) {
 	if cfg.General.MaxConnections <= 0 {
 		cfg.General.MaxConnections = defaultMaxConnections
 	}
+	if cfg.General.BindTimeout == 0 {
+		cfg.General.BindTimeout = defaultBindTimeout
+	}
+	if cfg.General.ChainCacheSize == 0 {
+		cfg.General.ChainCacheSize = defaultChainCacheSize
+	}
+	if cfg.General.RaceConcurrency == 0 {
+		cfg.General.RaceConcurrency = defaultRaceConcurrency
+	}
+	if cfg.General.ChainMaxAttempts == 0 {
+		cfg.General.ChainMaxAttempts = defaultChainMaxAttempts
+	}
+	if cfg.General.GeoIPReloadInterval == 0 {
+		cfg.General.GeoIPReloadInterval = defaultGeoIPReloadInterval
+	}
 	if err := validateConfig(&cfg); err != nil {
 		return Config{}, err
 	}
@@ -116,11 +245,30 @@ func loadConfig(path string) (Config, error) {
 }
 
 func validateConfig(cfg *Config) error {
-	if cfg.General.Bind == "" {
-		return fmt.Errorf("general.bind is required")
-	}
-	if cfg.General.Port <= 0 || cfg.General.Port > 65535 {
-		return fmt.Errorf("general.port must be between 1 and 65535")
+	if len(cfg.Listeners) > 0 {
+		g := cfg.General
+		if g.Bind != "" || g.Port != 0 || g.HTTPPort != 0 || g.TLS != nil || g.Socks4 {
+			return fmt.Errorf("general.bind, port, http_port, tls and socks4 cannot be combined with listeners")
+		}
+		if err := validateListeners(cfg); err != nil {
+			return err
+		}
+	} else {
+		if cfg.General.Bind == "" {
+			return fmt.Errorf("general.bind is required")
+		}
+		if cfg.General.Port <= 0 || cfg.General.Port > 65535 {
+			return fmt.Errorf("general.port must be between 1 and 65535")
+		}
+		if cfg.General.HTTPPort < 0 || cfg.General.HTTPPort > 65535 {
+			return fmt.Errorf("general.http_port must be between 1 and 65535, or 0 to disable")
+		}
+		if cfg.General.HTTPPort > 0 && cfg.General.HTTPPort == cfg.General.Port {
+			return fmt.Errorf("general.http_port must differ from general.port")
+		}
+		if err := validateListenerTLS(cfg.General.TLS); err != nil {
+			return fmt.Errorf("general.%w", err)
+		}
 	}
 	if cfg.General.HealthCheckInterval <= 0 {
 		return fmt.Errorf("general.health_check_interval must be positive")
@@ -128,6 +276,24 @@ func validateConfig(cfg *Config) error {
 	if cfg.General.ChainCleanupInterval < 0 {
 		return fmt.Errorf("general.chain_cleanup_interval must be non-negative")
 	}
+	if cfg.General.ChainCacheSize < 0 {
+		return fmt.Errorf("general.chain_cache_size must be positive")
+	}
+	if cfg.General.RaceDelay < 0 {
+		return fmt.Errorf("general.race_delay must be non-negative")
+	}
+	if cfg.General.RaceConcurrency < 0 {
+		return fmt.Errorf("general.race_concurrency must be positive")
+	}
+	if cfg.General.ChainMaxAttempts < 0 {
+		return fmt.Errorf("general.chain_max_attempts must be positive")
+	}
+	if cfg.General.ChainDialTimeout < 0 {
+		return fmt.Errorf("general.chain_dial_timeout must be non-negative")
+	}
+	if err := validateCircuitBreaker(cfg.General.CircuitBreaker); err != nil {
+		return fmt.Errorf("general.%w", err)
+	}
 	if cfg.General.ConfigReloadInterval < 0 {
 		return fmt.Errorf("general.config_reload_interval must be non-negative")
 	}
@@ -137,6 +303,21 @@ func validateConfig(cfg *Config) error {
 	if cfg.General.HealthCheckConcurrent <= 0 {
 		return fmt.Errorf("general.health_check_concurrency must be positive")
 	}
+	if err := validateHealthCheck(cfg.General); err != nil {
+		return err
+	}
+	if cfg.General.HealthCheckRise < 0 || cfg.General.HealthCheckFall < 0 {
+		return fmt.Errorf("general.health_check_rise and health_check_fall must be positive")
+	}
+	if cfg.General.HealthCheckJitter < 0 {
+		return fmt.Errorf("general.health_check_jitter must be non-negative")
+	}
+	if cfg.General.SlowStart < 0 {
+		return fmt.Errorf("general.slow_start must be non-negative")
+	}
+	if cfg.General.GeoIPReloadInterval < 0 {
+		return fmt.Errorf("general.geoip_reload_interval must be positive")
+	}
 	if cfg.General.IOTimeout <= 0 {
 		return fmt.Errorf("general.io_timeout must be positive")
 	}
@@ -146,6 +327,12 @@ func validateConfig(cfg *Config) error {
 	if cfg.General.MaxConnections <= 0 {
 		return fmt.Errorf("general.max_connections must be positive")
 	}
+	if cfg.General.BindTimeout < 0 {
+		return fmt.Errorf("general.bind_timeout must be non-negative")
+	}
+	if err := validatePools(cfg); err != nil {
+		return err
+	}
 	for ci, uc := range cfg.Chains {
 		if len(uc.Username) > 255 {
 			return fmt.Errorf("chains[%d]: username too long", ci)
@@ -154,70 +341,167 @@ func validateConfig(cfg *Config) error {
 			return fmt.Errorf("chains[%d]: password too long", ci)
 		}
 		for hi, hop := range uc.Chain {
-			if len(hop.Proxies) > 0 {
-				strat := strings.ToLower(hop.Strategy)
-				if strat != "" && strat != "rr" && strat != "random" && strat != "priority" {
-					return fmt.Errorf("chains[%d].chain[%d]: invalid strategy %q", ci, hi, hop.Strategy)
-				}
-				for pi, p := range hop.Proxies {
-					if p.Host == "" {
-						return fmt.Errorf("chains[%d].chain[%d].proxies[%d]: host is required", ci, hi, pi)
-					}
-					if p.Port <= 0 || p.Port > 65535 {
-						return fmt.Errorf("chains[%d].chain[%d].proxies[%d]: port must be between 1 and 65535", ci, hi, pi)
-					}
-					if len(p.Username) > 255 {
-						return fmt.Errorf("chains[%d].chain[%d].proxies[%d]: username too long", ci, hi, pi)
-					}
-					if len(p.Password) > 255 {
-						return fmt.Errorf("chains[%d].chain[%d].proxies[%d]: password too long", ci, hi, pi)
-					}
-				}
-			} else {
-				if hop.Host == "" {
-					return fmt.Errorf("chains[%d].chain[%d]: host is required", ci, hi)
-				}
-				if hop.Port <= 0 || hop.Port > 65535 {
-					return fmt.Errorf("chains[%d].chain[%d]: port must be between 1 and 65535", ci, hi)
-				}
-				if len(hop.Username) > 255 {
-					return fmt.Errorf("chains[%d].chain[%d]: username too long", ci, hi)
-				}
-				if len(hop.Password) > 255 {
-					return fmt.Errorf("chains[%d].chain[%d]: password too long", ci, hi)
-				}
+			if err := validateHop(cfg, hop, fmt.Sprintf("chains[%d].chain[%d]", ci, hi)); err != nil {
+				return err
+			}
+		}
+	}
+	return validateRules(cfg)
+}
+
+func validStrategy(s string) bool {
+	switch strings.ToLower(s) {
+	case "", "rr", "random", "priority", "latency", "weighted", "least_conn", "hash":
+		return true
+	}
+	return false
+}
+
+func validateHop(cfg *Config, hop *Hop, prefix string) error {
+	if hop.Pool != "" && (len(hop.Proxies) > 0 || hop.Host != "") {
+		return fmt.Errorf("%s: pool cannot be combined with proxies or host", prefix)
+	}
+	if hop.Pool != "" && !cfg.hasPool(hop.Pool) {
+		return fmt.Errorf("%s: unknown pool %q", prefix, hop.Pool)
+	}
+	if len(hop.Proxies) > 0 || hop.Pool != "" {
+		if !validStrategy(hop.Strategy) {
+			return fmt.Errorf("%s: invalid strategy %q", prefix, hop.Strategy)
+		}
+		switch strings.ToLower(hop.HashKey) {
+		case "", "host", "client", "user":
+		default:
+			return fmt.Errorf("%s: invalid hash_key %q", prefix, hop.HashKey)
+		}
+		for pi, p := range hop.Proxies {
+			if err := validateProxy(p); err != nil {
+				return fmt.Errorf("%s.proxies[%d]: %w", prefix, pi, err)
 			}
 		}
+	} else {
+		if hop.Host == "" {
+			return fmt.Errorf("%s: host is required", prefix)
+		}
+		if hop.Port <= 0 || hop.Port > 65535 {
+			return fmt.Errorf("%s: port must be between 1 and 65535", prefix)
+		}
+		if len(hop.Username) > 255 {
+			return fmt.Errorf("%s: username too long", prefix)
+		}
+		if len(hop.Password) > 255 {
+			return fmt.Errorf("%s: password too long", prefix)
+		}
+		if !validProxyType(hop.Type) {
+			return fmt.Errorf("%s: invalid type %q", prefix, hop.Type)
+		}
+		if err := validateProxyTLS(hop.TLS); err != nil {
+			return fmt.Errorf("%s: %w", prefix, err)
+		}
 	}
 	return nil
 }
 
-func initProxies(cfg *Config) {
-	for i := range cfg.Chains {
-		chain := &cfg.Chains[i]
-		for j := range chain.Chain {
-			hop := chain.Chain[j]
-			if len(hop.Proxies) == 0 && hop.Host != "" {
-				p := &Proxy{
-					Name:     hop.Name,
-					Username: hop.Username,
-					Password: hop.Password,
-					Host:     hop.Host,
-					Port:     hop.Port,
-				}
-				p.alive.Store(true)
-				hop.Proxies = []*Proxy{p}
+func validateProxy(p *Proxy) error {
+	if p.Host == "" {
+		return fmt.Errorf("host is required")
+	}
+	if p.Port <= 0 || p.Port > 65535 {
+		return fmt.Errorf("port must be between 1 and 65535")
+	}
+	if len(p.Username) > 255 {
+		return fmt.Errorf("username too long")
+	}
+	if len(p.Password) > 255 {
+		return fmt.Errorf("password too long")
+	}
+	if !validProxyType(p.Type) {
+		return fmt.Errorf("invalid type %q", p.Type)
+	}
+	if p.Weight < 0 {
+		return fmt.Errorf("weight must not be negative")
+	}
+	return validateProxyTLS(p.TLS)
+}
+
+func validProxyType(t string) bool {
+	switch strings.ToLower(t) {
+	case "", "socks5", "socks4", "socks4a", "http":
+		return true
+	}
+	return false
+}
+
+func initProxies(cfg *Config) error {
+	return reinitProxies(cfg, nil)
+}
+
+// reinitProxies is initProxies for a reloaded config. Upstreams that prev
+// already uses keep their *Proxy, and with it their health, latency and
+// circuit breaker state.
+func reinitProxies(cfg, prev *Config) error {
+	reg := make(proxyRegistry)
+	kept := make(map[*Proxy]bool)
+	if prev != nil {
+		for _, p := range prev.uniqueProxies() {
+			reg[keyOf(p)] = p
+			kept[p] = true
+		}
+	}
+	for _, p := range cfg.Proxies {
+		reg.canonical(p)
+	}
+	for _, hop := range cfg.hops() {
+		if hop.Pool != "" {
+			hop.Proxies = cfg.poolProxies(hop.Pool)
+		} else if len(hop.Proxies) == 0 && hop.Host != "" {
+			hop.Proxies = []*Proxy{{
+				Name:     hop.Name,
+				Type:     hop.Type,
+				Username: hop.Username,
+				Password: hop.Password,
+				Host:     hop.Host,
+				Port:     hop.Port,
+				TLS:      hop.TLS,
+			}}
+		}
+		// Definitions of the same upstream share one proxy, so its
+		// health and stats are tracked once however many hops list it.
+		proxies := make([]*Proxy, 0, len(hop.Proxies))
+		members := make(map[*Proxy]hopMember, len(hop.Proxies))
+		for _, p := range hop.Proxies {
+			m := hop.member(p)
+			p = reg.canonical(p)
+			if _, ok := members[p]; !ok {
+				proxies = append(proxies, p)
+				members[p] = m
 			}
-			if hop.priorityRR == nil {
-				hop.priorityRR = make(map[int]*uint32)
+		}
+		hop.Proxies, hop.members = proxies, members
+		if hop.priorityRR == nil {
+			hop.priorityRR = make(map[int]*uint32)
+		}
+		for _, m := range hop.members {
+			if _, ok := hop.priorityRR[m.priority]; !ok {
+				var v uint32
+				hop.priorityRR[m.priority] = &v
 			}
-			for _, p := range hop.Proxies {
-				p.alive.Store(true)
-				if _, ok := hop.priorityRR[p.Priority]; !ok {
-					var v uint32
-					hop.priorityRR[p.Priority] = &v
-				}
+		}
+	}
+	for i, p := range cfg.Proxies {
+		cfg.Proxies[i] = reg.canonical(p)
+	}
+	for _, p := range reg {
+		if kept[p] {
+			continue
+		}
+		p.alive.Store(true)
+		if p.TLS != nil && p.TLS.Enabled {
+			conf, err := buildProxyTLS(p.TLS, p.Host)
+			if err != nil {
+				return fmt.Errorf("proxy %s: %w", p.Name, err)
 			}
+			p.tlsConfig = conf
 		}
 	}
+	return nil
 }
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const defaultGeoIPReloadInterval = time.Minute
+
+// geoDatabase is an MMDB file that is reopened when it changes on disk.
+type geoDatabase struct {
+	path    string
+	reader  atomic.Pointer[mmdbReader]
+	modTime time.Time
+	size    int64
+}
+
+var (
+	countryDB atomic.Pointer[geoDatabase]
+	asnDB     atomic.Pointer[geoDatabase]
+)
+
+// rulesResolve makes rules with IP conditions resolve domain destinations
+// to match them. It is set again on config reload.
+var rulesResolve atomic.Bool
+
+// resolveHost is replaced in tests.
+var resolveHost = func(ctx context.Context, host string) ([]net.IP, error) {
+	return net.DefaultResolver.LookupIP(ctx, "ip", host)
+}
+
+func openGeoDatabase(path string) (*geoDatabase, error) {
+	db := &geoDatabase{path: path}
+	if _, err := db.refresh(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// refresh reopens the file if its size or modification time changed and
+// reports whether it did. On error the previous contents stay in use.
+func (db *geoDatabase) refresh() (bool, error) {
+	fi, err := os.Stat(db.path)
+	if err != nil {
+		return false, err
+	}
+	if db.reader.Load() != nil && fi.ModTime().Equal(db.modTime) && fi.Size() == db.size {
+		return false, nil
+	}
+	r, err := openMMDB(db.path)
+	if err != nil {
+		return false, err
+	}
+	db.reader.Store(r)
+	db.modTime, db.size = fi.ModTime(), fi.Size()
+	return true, nil
+}
+
+// initGeoIP opens the databases configured in g. On config reload,
+// databases whose path did not change are left to startGeoIPReload, and
+// when one fails to open none is replaced.
+func initGeoIP(g General) error {
+	dbs := []struct {
+		field string
+		path  string
+		ptr   *atomic.Pointer[geoDatabase]
+		db    *geoDatabase
+	}{
+		{field: "geoip_database", path: g.GeoIPDatabase, ptr: &countryDB},
+		{field: "asn_database", path: g.ASNDatabase, ptr: &asnDB},
+	}
+	for i, d := range dbs {
+		cur := d.ptr.Load()
+		switch {
+		case d.path == "":
+		case cur != nil && cur.path == d.path:
+			dbs[i].db = cur
+		default:
+			db, err := openGeoDatabase(d.path)
+			if err != nil {
+				return fmt.Errorf("general.%s: %w", d.field, err)
+			}
+			dbs[i].db = db
+		}
+	}
+	for _, d := range dbs {
+		d.ptr.Store(d.db)
+	}
+	return nil
+}
+
+// startGeoIPReload polls the databases for changes every interval. It
+// runs even without databases, as a config reload may add them.
+func startGeoIPReload(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			for _, db := range []*geoDatabase{countryDB.Load(), asnDB.Load()} {
+				if db == nil {
+					continue
+				}
+				reloaded, err := db.refresh()
+				switch {
+				case err != nil:
+					warnLog.Printf("geoip reload %s: %v", db.path, err)
+				case reloaded:
+					infoLog.Printf("reloaded geoip database %s", db.path)
+				}
+			}
+		}
+	}()
+}
+
+func (db *geoDatabase) lookup(ip net.IP) any {
+	if db == nil || ip == nil {
+		return nil
+	}
+	rec, err := db.reader.Load().lookup(ip)
+	if err != nil {
+		debugLog.Printf("geoip lookup %s in %s: %v", ip, db.path, err)
+		return nil
+	}
+	return rec
+}
+
+// lookupCountry returns the ISO country code of ip, or "" when unknown.
+// Addresses without a country, such as anycast ones, fall back to the
+// country they are registered in.
+func lookupCountry(ip net.IP) string {
+	rec := countryDB.Load().lookup(ip)
+	for _, key := range []string{"country", "registered_country"} {
+		if code, ok := mmdbField(rec, key, "iso_code").(string); ok {
+			return strings.ToUpper(code)
+		}
+	}
+	return ""
+}
+
+// lookupASN returns the autonomous system number of ip, or 0 when unknown.
+func lookupASN(ip net.IP) uint32 {
+	asn, _ := mmdbField(asnDB.Load().lookup(ip), "autonomous_system_number").(uint64)
+	return uint32(asn)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testGeoNetworks = map[string]map[string]any{
+	"1.0.1.0/24": {
+		"country":                  map[string]any{"iso_code": "CN"},
+		"autonomous_system_number": uint32(4134),
+	},
+	"8.8.8.0/24": {
+		"registered_country":       map[string]any{"iso_code": "us"},
+		"autonomous_system_number": uint32(15169),
+	},
+	"2001:db8::/32": {"country": map[string]any{"iso_code": "DE"}},
+}
+
+// withGeoIP opens path as both the country and the ASN database for the
+// duration of the test.
+func withGeoIP(t *testing.T, path string) {
+	t.Helper()
+	if err := initGeoIP(General{GeoIPDatabase: path, ASNDatabase: path}); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	t.Cleanup(func() {
+		countryDB.Store(nil)
+		asnDB.Store(nil)
+	})
+}
+
+func TestLookupCountryASN(t *testing.T) {
+	withGeoIP(t, writeMMDB(t, testGeoNetworks))
+	tests := []struct {
+		ip      string
+		country string
+		asn     uint32
+	}{
+		{"1.0.1.5", "CN", 4134},
+		{"8.8.8.8", "US", 15169},
+		{"2001:db8::1", "DE", 0},
+		{"192.0.2.1", "", 0},
+	}
+	for _, tt := range tests {
+		ip := net.ParseIP(tt.ip)
+		if got := lookupCountry(ip); got != tt.country {
+			t.Errorf("%s: country %q, want %q", tt.ip, got, tt.country)
+		}
+		if got := lookupASN(ip); got != tt.asn {
+			t.Errorf("%s: asn %d, want %d", tt.ip, got, tt.asn)
+		}
+	}
+	if got := lookupCountry(nil); got != "" {
+		t.Errorf("nil address: country %q", got)
+	}
+}
+
+func TestInitGeoIPMissingFile(t *testing.T) {
+	err := initGeoIP(General{ASNDatabase: filepath.Join(t.TempDir(), "missing.mmdb")})
+	if err == nil || !strings.HasPrefix(err.Error(), "general.asn_database: ") {
+		t.Fatalf("expected asn_database error, got %v", err)
+	}
+}
+
+func TestGeoDatabaseRefresh(t *testing.T) {
+	path := writeMMDB(t, testGeoNetworks)
+	db, err := openGeoDatabase(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if reloaded, err := db.refresh(); reloaded || err != nil {
+		t.Fatalf("unchanged file: reloaded=%v err=%v", reloaded, err)
+	}
+
+	buf := buildMMDB(t, 6, 28, map[string]map[string]any{"1.0.1.0/24": {"country": map[string]any{"iso_code": "JP"}}})
+	if err := os.WriteFile(path, buf, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	// Make sure the change is visible even on coarse timestamps.
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(path, future, future)
+	if reloaded, err := db.refresh(); !reloaded || err != nil {
+		t.Fatalf("changed file: reloaded=%v err=%v", reloaded, err)
+	}
+	countryDB.Store(db)
+	defer countryDB.Store(nil)
+	if got := lookupCountry(net.ParseIP("1.0.1.1")); got != "JP" {
+		t.Fatalf("country after reload %q, want JP", got)
+	}
+
+	if err := os.WriteFile(path, []byte("not a database"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := db.refresh(); err == nil {
+		t.Fatal("expected error for a corrupt file")
+	}
+	if got := lookupCountry(net.ParseIP("1.0.1.1")); got != "JP" {
+		t.Fatalf("country after failed reload %q, want JP", got)
+	}
+}
+
+func TestRuleGeoIPMatches(t *testing.T) {
+	origDebug := debugLog
+	debugLog = nopLogger{}
+	defer func() { debugLog = origDebug }()
+	withGeoIP(t, writeMMDB(t, testGeoNetworks))
+
+	origResolve, origResolveHost := rulesResolve.Load(), resolveHost
+	defer func() { rulesResolve.Store(origResolve); resolveHost = origResolveHost }()
+	lookups := 0
+	resolveHost = func(ctx context.Context, host string) ([]net.IP, error) {
+		lookups++
+		if host == "cn.example" {
+			return []net.IP{net.ParseIP("1.0.1.9")}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	tests := []struct {
+		name    string
+		rule    Rule
+		client  string
+		host    string
+		resolve bool
+		want    bool
+	}{
+		{"country", Rule{GeoIP: []string{"cn"}}, "", "1.0.1.1", false, true},
+		{"country miss", Rule{GeoIP: []string{"DE"}}, "", "1.0.1.1", false, false},
+		{"registered country", Rule{GeoIP: []string{"US"}}, "", "8.8.8.8", false, true},
+		{"unknown address", Rule{GeoIP: []string{"US"}}, "", "192.0.2.1", false, false},
+		{"asn", Rule{ASN: []uint32{15169}}, "", "8.8.8.8", false, true},
+		{"asn miss", Rule{ASN: []uint32{15169}}, "", "1.0.1.1", false, false},
+		{"domain unresolved", Rule{GeoIP: []string{"CN"}}, "", "cn.example", false, false},
+		{"domain resolved", Rule{GeoIP: []string{"CN"}}, "", "cn.example", true, true},
+		{"resolve failure", Rule{GeoIP: []string{"CN"}}, "", "missing.example", true, false},
+		{"domain or country", Rule{Domain: []string{"cn.example"}, GeoIP: []string{"DE"}}, "", "cn.example", true, true},
+		{"client country", Rule{ClientGeoIP: []string{"DE"}}, "2001:db8::5", "example.com", false, true},
+		{"client country miss", Rule{ClientGeoIP: []string{"DE"}}, "1.0.1.1", "example.com", false, false},
+		{"client asn", Rule{ClientASN: []uint32{4134}}, "1.0.1.1", "example.com", false, true},
+		{"no client", Rule{ClientASN: []uint32{4134}}, "", "example.com", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rulesResolve.Store(tt.resolve)
+			r := tt.rule
+			r.Action = "direct"
+			if err := r.compile(); err != nil {
+				t.Fatalf("compile: %v", err)
+			}
+			q := &ruleRequest{ctx: t.Context(), client: net.ParseIP(tt.client), host: tt.host, port: 443, ip: net.ParseIP(tt.host)}
+			if got := r.matches(q); got != tt.want {
+				t.Fatalf("matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// A request is resolved at most once, however many rules need it.
+	rulesResolve.Store(true)
+	lookups = 0
+	q := &ruleRequest{ctx: t.Context(), host: "missing.example", port: 443}
+	for _, codes := range [][]string{{"US"}, {"DE"}} {
+		r := Rule{GeoIP: codes, Action: "direct"}
+		r.compile()
+		r.matches(q)
+	}
+	if lookups != 1 {
+		t.Fatalf("resolved %d times, want 1", lookups)
+	}
+}
+
+func TestValidateRulesGeoIP(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		want string
+	}{
+		{"geoip without database", Config{Rules: []*Rule{{GeoIP: []string{"CN"}, Action: "reject"}}}, "rules[0]: geoip requires general.geoip_database"},
+		{"client geoip without database", Config{Rules: []*Rule{{ClientGeoIP: []string{"CN"}, Action: "reject"}}}, "rules[0]: geoip requires general.geoip_database"},
+		{"asn without database", Config{Rules: []*Rule{{ASN: []uint32{1}, Action: "reject"}}}, "rules[0]: asn requires general.asn_database"},
+		{"bad country code", Config{General: General{GeoIPDatabase: "x"}, Rules: []*Rule{{GeoIP: []string{"CHN"}, Action: "reject"}}}, `rules[0]: invalid country code "CHN"`},
+		{"ok", Config{General: General{GeoIPDatabase: "x", ASNDatabase: "y"}, Rules: []*Rule{{GeoIP: []string{"CN"}, ClientASN: []uint32{1}, Action: "reject"}}}, ""},
+	}
+	for _, tt := range tests {
+		err := validateRules(&tt.cfg)
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		case tt.want != "" && (err == nil || err.Error() != tt.want):
+			t.Errorf("%s: expected %q, got %v", tt.name, tt.want, err)
+		}
+	}
+}
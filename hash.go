@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type clientAddrKey struct{}
+
+// clientContext returns a context carrying the address of the client on
+// conn, for strategies that select proxies by client.
+func clientContext(conn net.Conn) context.Context {
+	return context.WithValue(context.Background(), clientAddrKey{}, conn.RemoteAddr())
+}
+
+func clientIPFromContext(ctx context.Context) string {
+	addr, _ := ctx.Value(clientAddrKey{}).(net.Addr)
+	if ta, ok := addr.(*net.TCPAddr); ok {
+		return ta.IP.String()
+	}
+	if addr != nil {
+		return addr.String()
+	}
+	return ""
+}
+
+// dialInfo describes a chain request for strategies that pick proxies by
+// destination, client or user, and the proxy tags the client prefers.
+type dialInfo struct {
+	host    string
+	client  string
+	user    string
+	group   string
+	country string
+}
+
+// hashKey returns the key the hash strategy of h uses for info.
+func (h *Hop) hashKey(info dialInfo) string {
+	switch strings.ToLower(h.HashKey) {
+	case "client":
+		return info.client
+	case "user":
+		return info.user
+	}
+	return strings.ToLower(info.host)
+}
+
+// orderByHash orders proxies by weighted rendezvous hashing of key. The
+// same key keeps leading with the same proxy, and when a proxy dies only
+// the keys it led move to other proxies.
+func (h *Hop) orderByHash(proxies []*Proxy, key string) []*Proxy {
+	scores := make(map[*Proxy]float64, len(proxies))
+	for _, p := range proxies {
+		scores[p] = rendezvousScore(key, p, h.weight(p))
+	}
+	sort.SliceStable(proxies, func(i, j int) bool {
+		return scores[proxies[i]] > scores[proxies[j]]
+	})
+	return proxies
+}
+
+func rendezvousScore(key string, p *Proxy, weight int) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(net.JoinHostPort(p.Host, strconv.Itoa(p.Port))))
+	// Uniform value in (0, 1) from the top 53 bits of the mixed hash.
+	u := (float64(mix64(h.Sum64())>>11) + 0.5) / (1 << 53)
+	return -float64(weight) / math.Log(u)
+}
+
+// mix64 is the splitmix64 finalizer, spreading FNV's weak low bits.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
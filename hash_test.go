@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestHashStrategy(t *testing.T) {
+	var proxies []*Proxy
+	for i := 1; i <= 4; i++ {
+		proxies = append(proxies, &Proxy{Name: fmt.Sprintf("p%d", i), Host: "10.0.0.1", Port: i})
+	}
+	cfg := Config{Chains: []UserChain{{Chain: []*Hop{{Strategy: "hash", Proxies: proxies}}}}}
+	initProxies(&cfg)
+	hop := cfg.Chains[0].Chain[0]
+
+	leaders := make(map[string]*Proxy)
+	used := make(map[*Proxy]int)
+	for i := 0; i < 200; i++ {
+		host := fmt.Sprintf("site%d.example", i)
+		res := hop.orderedProxies(dialInfo{host: host})
+		if len(res) != 4 {
+			t.Fatalf("expected 4 proxies, got %d", len(res))
+		}
+		if again := hop.orderedProxies(dialInfo{host: host}); again[0] != res[0] {
+			t.Fatalf("%s moved from %s to %s", host, res[0].Name, again[0].Name)
+		}
+		leaders[host] = res[0]
+		used[res[0]]++
+	}
+	for _, p := range proxies {
+		if used[p] < 20 {
+			t.Fatalf("uneven distribution: %v", used)
+		}
+	}
+
+	// Only the keys led by a dead proxy are remapped.
+	dead := proxies[0]
+	dead.alive.Store(false)
+	for host, leader := range leaders {
+		res := hop.orderedProxies(dialInfo{host: host})
+		if leader != dead && res[0] != leader {
+			t.Fatalf("%s remapped from %s to %s", host, leader.Name, res[0].Name)
+		}
+		if res[0] == dead {
+			t.Fatalf("%s still uses dead proxy", host)
+		}
+	}
+}
+
+func TestHashKey(t *testing.T) {
+	info := dialInfo{host: "Example.com", client: "192.0.2.1", user: "alice"}
+	for key, want := range map[string]string{"": "example.com", "host": "example.com", "client": "192.0.2.1", "user": "alice"} {
+		if got := (&Hop{HashKey: key}).hashKey(info); got != want {
+			t.Fatalf("hash_key %q: got %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestHashChainSkipsCache(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog = origWarn, origDebug }()
+
+	target := startPongServer(t)
+	defer target.Close()
+	hop := startTestServer(t, &Listener{}, nil)
+	defer hop.Close()
+
+	cfg := Config{Chains: []UserChain{{Username: "u", Chain: []*Hop{{Strategy: "hash", Proxies: []*Proxy{{Name: "up", Host: "127.0.0.1", Port: hop.Addr().(*net.TCPAddr).Port}}}}}}}
+	initProxies(&cfg)
+	state := &ChainState{name: "u", chain: cfg.Chains[0].Chain}
+	conn, err := dialChain(t.Context(), state, "127.0.0.1", target.Addr().(*net.TCPAddr).Port)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	pingPong(t, conn)
+	if state.destCache().len() != 0 {
+		t.Fatal("hash chain should not be cached")
+	}
+}
@@ -2,40 +2,211 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Health check settings, from the general section.
+var (
+	healthCheckMode   string
+	healthCheckTarget string
+	healthCheckSend   string
+	healthCheckExpect string
+)
+
 var checkProxyAlive = func(ctx context.Context, p *Proxy, timeout time.Duration) (bool, error) {
-	addr := net.JoinHostPort(p.Host, strconv.Itoa(p.Port))
-	d := net.Dialer{Timeout: timeout}
-	conn, err := d.DialContext(ctx, "tcp", addr)
+	var err error
+	switch healthCheckMode {
+	case "handshake":
+		err = checkHandshake(ctx, p, timeout)
+	case "connect", "chain":
+		err = checkConnect(ctx, p, timeout)
+	default:
+		addr := net.JoinHostPort(p.Host, strconv.Itoa(p.Port))
+		d := net.Dialer{Timeout: timeout}
+		var conn net.Conn
+		conn, err = d.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			conn.Close()
+		}
+	}
 	if err != nil {
 		return false, err
 	}
-	conn.Close()
 	return true, nil
 }
 
+func validateHealthCheck(g General) error {
+	switch strings.ToLower(g.HealthCheckMode) {
+	case "", "tcp", "handshake":
+		if g.HealthCheckTarget != "" || g.HealthCheckSend != "" || g.HealthCheckExpect != "" {
+			return fmt.Errorf("general.health_check_target, send and expect require health_check_mode connect or chain")
+		}
+		return nil
+	case "connect", "chain":
+	default:
+		return fmt.Errorf("general.health_check_mode must be tcp, handshake, connect or chain")
+	}
+	host, port, err := net.SplitHostPort(g.HealthCheckTarget)
+	if err != nil || host == "" {
+		return fmt.Errorf("general.health_check_target must be host:port")
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("general.health_check_target port must be between 1 and 65535")
+	}
+	return nil
+}
+
+// checkHandshake connects to p and negotiates with it using p's own
+// credentials. Only SOCKS5 proxies have a handshake that does not need a
+// destination; other types are only dialled.
+func checkHandshake(ctx context.Context, p *Proxy, timeout time.Duration) error {
+	conn, err := dialHop(ctx, nil, p, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	switch strings.ToLower(p.Type) {
+	case "", "socks5":
+		return socks5Auth(conn, p, timeout)
+	}
+	return nil
+}
+
+// checkConnect asks p to connect to the health check target and checks
+// the target's response.
+func checkConnect(ctx context.Context, p *Proxy, timeout time.Duration) error {
+	host, port := splitTarget(healthCheckTarget)
+	conn, _, err := requestProxy(ctx, nil, p, 0x01, host, port, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return probeTarget(conn, timeout)
+}
+
+func splitTarget(target string) (string, int) {
+	host, portStr, _ := net.SplitHostPort(target)
+	port, _ := strconv.Atoi(portStr)
+	return host, port
+}
+
+// probeTarget sends health_check_send over conn and checks that the
+// response starts with health_check_expect.
+func probeTarget(conn net.Conn, timeout time.Duration) error {
+	if healthCheckSend != "" {
+		conn.SetDeadline(time.Now().Add(timeout))
+		if err := writeFull(conn, []byte(healthCheckSend)); err != nil {
+			return fmt.Errorf("probe write: %w", err)
+		}
+	}
+	if healthCheckExpect == "" {
+		return nil
+	}
+	buf := make([]byte, len(healthCheckExpect))
+	conn.SetDeadline(time.Now().Add(timeout))
+	n, err := io.ReadFull(conn, buf)
+	if string(buf[:n]) != healthCheckExpect {
+		if err != nil {
+			return fmt.Errorf("probe read: %w", err)
+		}
+		return fmt.Errorf("unexpected probe response %q", buf[:n])
+	}
+	return nil
+}
+
+var chainProbeRound atomic.Uint32
+
+// probeCombo picks one live proxy per hop of chain, rotating between
+// rounds so that every proxy is eventually covered.
+func probeCombo(chain []*Hop, round int) []*Proxy {
+	combo := make([]*Proxy, 0, len(chain))
+	for _, h := range chain {
+		var alive []*Proxy
+		for _, p := range h.Proxies {
+			if p.alive.Load() {
+				alive = append(alive, p)
+			}
+		}
+		if len(alive) == 0 {
+			return nil
+		}
+		combo = append(combo, alive[round%len(alive)])
+	}
+	return combo
+}
+
+// checkChains walks every user's chain to the health check target and
+// logs which hop broke.
+func checkChains(ctx context.Context, cfg *Config) {
+	chains, _ := userChains.Load().(map[string]*ChainState)
+	host, port := splitTarget(healthCheckTarget)
+	round := int(chainProbeRound.Add(1) - 1)
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, cfg.General.HealthCheckConcurrent)
+	for name, st := range chains {
+		combo := probeCombo(st.chain, round)
+		if len(combo) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			// Each hop gets the full timeout, as in a real connection.
+			checkCtx, cancel := context.WithTimeout(ctx, time.Duration(len(combo))*cfg.General.HealthCheckTimeout)
+			defer cancel()
+			conn, err := connectThrough(checkCtx, combo, host, port)
+			if err == nil {
+				err = probeTarget(conn, cfg.General.HealthCheckTimeout)
+				conn.Close()
+			}
+			var he *hopError
+			switch {
+			case errors.As(err, &he):
+				warnLog.Printf("chain %s health check failed at hop %s: %v", name, he.proxy, he.err)
+			case err != nil:
+				warnLog.Printf("chain %s health check failed at target %s: %v", name, healthCheckTarget, err)
+			default:
+				debugLog.Printf("chain %s health check passed", name)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// healthCheckDelay returns the time until the next round of checks,
+// interval plus up to jitter so that instances started together do not
+// probe in step.
+func healthCheckDelay(interval, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return interval
+	}
+	return interval + time.Duration(rand.Int63n(int64(jitter)))
+}
+
 func startHealthChecks(ctx context.Context, cfg *Config) {
 	go func() {
-		ticker := time.NewTicker(cfg.General.HealthCheckInterval)
-		defer ticker.Stop()
+		timer := time.NewTimer(healthCheckDelay(cfg.General.HealthCheckInterval, cfg.General.HealthCheckJitter))
+		defer timer.Stop()
 		for {
 			select {
 			case <-ctx.Done():
 				return
-			case <-ticker.C:
+			case <-timer.C:
 			}
-			proxies := []*Proxy{}
+			timer.Reset(healthCheckDelay(cfg.General.HealthCheckInterval, cfg.General.HealthCheckJitter))
 			chainsMu.RLock()
-			for i := range cfg.Chains {
-				for j := range cfg.Chains[i].Chain {
-					proxies = append(proxies, cfg.Chains[i].Chain[j].Proxies...)
-				}
-			}
+			proxies := cfg.uniqueProxies()
 			chainsMu.RUnlock()
 			var wg sync.WaitGroup
 			sem := make(chan struct{}, cfg.General.HealthCheckConcurrent)
@@ -48,22 +219,21 @@ func startHealthChecks(ctx context.Context, cfg *Config) {
 					defer func() { <-sem }()
 					checkCtx, cancel := context.WithTimeout(ctx, cfg.General.HealthCheckTimeout)
 					defer cancel()
+					start := time.Now()
 					alive, err := checkProxyAlive(checkCtx, p, cfg.General.HealthCheckTimeout)
 					if err != nil {
 						warnLog.Printf("proxy %s health check error: %v", p.Name, err)
 					}
-					old := p.alive.Load()
-					if alive != old {
-						if alive {
-							infoLog.Printf("proxy %s recovered", p.Name)
-						} else {
-							warnLog.Printf("proxy %s marked dead", p.Name)
-						}
-						p.alive.Store(alive)
+					if alive {
+						p.observeLatency(time.Since(start))
 					}
+					p.reportHealth(alive, cfg.General.HealthCheckRise, cfg.General.HealthCheckFall)
 				}()
 			}
 			wg.Wait()
+			if healthCheckMode == "chain" {
+				checkChains(ctx, cfg)
+			}
 		}
 	}()
 }
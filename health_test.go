@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"log"
+	"net"
 	"strings"
 	"sync"
 	"testing"
@@ -87,3 +88,136 @@ func TestStartHealthChecksUpdatesAliveAndLogs(t *testing.T) {
 		})
 	}
 }
+
+func withHealthCheck(t *testing.T, mode, target, send, expect string) {
+	t.Helper()
+	origWarn, origInfo, origDebug := warnLog, infoLog, debugLog
+	warnLog, infoLog, debugLog = nopLogger{}, nopLogger{}, nopLogger{}
+	origMode, origTarget, origSend, origExpect := healthCheckMode, healthCheckTarget, healthCheckSend, healthCheckExpect
+	healthCheckMode, healthCheckTarget, healthCheckSend, healthCheckExpect = mode, target, send, expect
+	t.Cleanup(func() {
+		warnLog, infoLog, debugLog = origWarn, origInfo, origDebug
+		healthCheckMode, healthCheckTarget, healthCheckSend, healthCheckExpect = origMode, origTarget, origSend, origExpect
+	})
+}
+
+func TestCheckProxyHandshake(t *testing.T) {
+	withHealthCheck(t, "handshake", "", "", "")
+	chains := map[string]*ChainState{"alice": {password: "pass"}}
+	hop := startTestServer(t, &Listener{}, chains)
+	defer hop.Close()
+	port := hop.Addr().(*net.TCPAddr).Port
+
+	good := &Proxy{Name: "good", Host: "127.0.0.1", Port: port, Username: "alice", Password: "pass"}
+	if ok, err := checkProxyAlive(t.Context(), good, time.Second); !ok {
+		t.Fatalf("expected handshake to pass: %v", err)
+	}
+	bad := &Proxy{Name: "bad", Host: "127.0.0.1", Port: port, Username: "alice", Password: "wrong"}
+	if ok, _ := checkProxyAlive(t.Context(), bad, time.Second); ok {
+		t.Fatal("expected handshake with wrong credentials to fail")
+	}
+}
+
+func TestCheckProxyConnect(t *testing.T) {
+	hop := startTestServer(t, &Listener{}, nil)
+	defer hop.Close()
+	p := &Proxy{Name: "p", Host: "127.0.0.1", Port: hop.Addr().(*net.TCPAddr).Port}
+
+	for _, tt := range []struct {
+		expect string
+		ok     bool
+	}{{"pong", true}, {"nope", false}} {
+		target := startPongServer(t)
+		withHealthCheck(t, "connect", target.Addr().String(), "ping", tt.expect)
+		ok, err := checkProxyAlive(t.Context(), p, time.Second)
+		target.Close()
+		if ok != tt.ok {
+			t.Fatalf("expect %q: got ok=%v (%v)", tt.expect, ok, err)
+		}
+	}
+}
+
+func TestCheckChainsReportsBrokenHop(t *testing.T) {
+	target := startPongServer(t)
+	defer target.Close()
+	withHealthCheck(t, "chain", target.Addr().String(), "ping", "pong")
+	var buf testLogBuffer
+	warnLog = log.New(&buf, "", 0)
+
+	hop := startTestServer(t, &Listener{}, nil)
+	defer hop.Close()
+	first := &Proxy{Name: "first", Host: "127.0.0.1", Port: hop.Addr().(*net.TCPAddr).Port}
+	broken := &Proxy{Name: "broken", Host: "127.0.0.1", Port: closedPort(t)}
+	cfg := &Config{
+		General: General{HealthCheckTimeout: time.Second, HealthCheckConcurrent: 1},
+		Chains:  []UserChain{{Username: "alice", Chain: []*Hop{{Proxies: []*Proxy{first}}, {Proxies: []*Proxy{broken}}}}},
+	}
+	initProxies(cfg)
+	userChains.Store(map[string]*ChainState{"alice": {name: "alice", chain: cfg.Chains[0].Chain}})
+	defer userChains.Store(map[string]*ChainState{})
+
+	checkChains(t.Context(), cfg)
+	// first cannot reach broken, which is reported as a failure on first.
+	if !strings.Contains(buf.String(), "chain alice health check failed at hop first") {
+		t.Fatalf("unexpected log %q", buf.String())
+	}
+}
+
+func TestValidateHealthCheck(t *testing.T) {
+	for _, g := range []General{
+		{HealthCheckMode: "icmp"},
+		{HealthCheckMode: "connect"},
+		{HealthCheckMode: "connect", HealthCheckTarget: "example.com"},
+		{HealthCheckMode: "chain", HealthCheckTarget: "example.com:0"},
+		{HealthCheckMode: "tcp", HealthCheckExpect: "HTTP/1."},
+	} {
+		if err := validateHealthCheck(g); err == nil {
+			t.Fatalf("expected error for %+v", g)
+		}
+	}
+	for _, g := range []General{
+		{HealthCheckMode: "connect", HealthCheckTarget: "example.com:80"},
+		{HealthCheckMode: "Chain", HealthCheckTarget: "example.com:80"},
+		{HealthCheckMode: "HANDSHAKE"},
+	} {
+		if err := validateHealthCheck(g); err != nil {
+			t.Fatalf("unexpected error for %+v: %v", g, err)
+		}
+	}
+}
+
+func TestHealthRiseFall(t *testing.T) {
+	withHealthCheck(t, "tcp", "", "", "")
+	p := aliveProxy("p")
+	p.reportHealth(false, 2, 3)
+	p.reportHealth(false, 2, 3)
+	p.reportHealth(true, 2, 3)
+	p.reportHealth(false, 2, 3)
+	p.reportHealth(false, 2, 3)
+	if !p.alive.Load() {
+		t.Fatal("marked dead before 3 consecutive failures")
+	}
+	p.reportHealth(false, 2, 3)
+	if p.alive.Load() {
+		t.Fatal("not marked dead after 3 consecutive failures")
+	}
+	p.reportHealth(true, 2, 3)
+	if p.alive.Load() {
+		t.Fatal("recovered after a single success")
+	}
+	p.reportHealth(true, 2, 3)
+	if !p.alive.Load() || p.recoveredAt.Load() == 0 {
+		t.Fatal("not recovered after 2 consecutive successes")
+	}
+}
+
+func TestHealthCheckDelay(t *testing.T) {
+	if d := healthCheckDelay(time.Second, 0); d != time.Second {
+		t.Fatalf("expected interval without jitter, got %s", d)
+	}
+	for i := 0; i < 100; i++ {
+		if d := healthCheckDelay(time.Second, 100*time.Millisecond); d < time.Second || d >= 1100*time.Millisecond {
+			t.Fatalf("delay %s outside interval plus jitter", d)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// httpConnectHop asks an HTTP proxy hop to open a tunnel to host:port with
+// the CONNECT method. conn is closed on failure.
+func httpConnectHop(conn net.Conn, hop *Proxy, host string, port int, timeout time.Duration) (net.Conn, error) {
+	target := net.JoinHostPort(host, strconv.Itoa(port))
+	req := "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n"
+	if hop.Username != "" || hop.Password != "" {
+		cred := base64.StdEncoding.EncodeToString([]byte(hop.Username + ":" + hop.Password))
+		req += "Proxy-Authorization: Basic " + cred + "\r\n"
+	}
+	req += "\r\n"
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := writeFull(conn, []byte(req)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	tp := textproto.NewReader(br)
+	conn.SetDeadline(time.Now().Add(timeout))
+	line, err := tp.ReadLine()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	proto, status, ok := strings.Cut(line, " ")
+	if !ok || !strings.HasPrefix(proto, "HTTP/1.") || len(status) < 3 {
+		conn.Close()
+		return nil, fmt.Errorf("bad status line %q from hop %s", line, hop.Name)
+	}
+	code, err := strconv.Atoi(status[:3])
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("bad status line %q from hop %s", line, hop.Name)
+	}
+	if _, err := tp.ReadMIMEHeader(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	switch {
+	case code == 407:
+		conn.Close()
+		return nil, fmt.Errorf("auth failed for hop %s", hop.Name)
+	case code == 502 || code == 503 || code == 504:
+		conn.Close()
+		return nil, &targetError{fmt.Errorf("connect failed on hop %s: %s", hop.Name, status)}
+	case code < 200 || code > 299:
+		conn.Close()
+		return nil, fmt.Errorf("connect failed on hop %s: %s", hop.Name, status)
+	}
+	conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn returns data already buffered by r before reading from the
+// underlying connection again.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
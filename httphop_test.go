@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestConnectThroughHTTPHop(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog = origWarn, origDebug }()
+
+	target := startPongServer(t)
+	defer target.Close()
+	socksHop := startTestServer(t, &Listener{}, nil)
+	defer socksHop.Close()
+	httpHop := startTestServer(t, &Listener{Protocol: "http"}, map[string]*ChainState{"hu": {password: "hp"}})
+	defer httpHop.Close()
+
+	cfg := Config{Chains: []UserChain{{Username: "u", Password: "p", Chain: []*Hop{
+		{Name: "s", Host: "127.0.0.1", Port: socksHop.Addr().(*net.TCPAddr).Port},
+		{Name: "h", Type: "http", Username: "hu", Password: "hp", Host: "127.0.0.1", Port: httpHop.Addr().(*net.TCPAddr).Port},
+	}}}}
+	initProxies(&cfg)
+	chains, err := buildUserChains(cfg.Chains)
+	if err != nil {
+		t.Fatalf("build chains: %v", err)
+	}
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() { handleConn(server, chains, &Listener{}); close(done) }()
+
+	if code := socks5Connect(t, client, "u", "p", target.Addr().(*net.TCPAddr)); code != 0x00 {
+		t.Fatalf("expected response 0x00, got 0x%02X", code)
+	}
+	pingPong(t, client)
+	client.Close()
+	<-done
+}
+
+func TestConnectThroughHTTPHopAuthFailed(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog = origWarn, origDebug }()
+
+	httpHop := startTestServer(t, &Listener{Protocol: "http"}, map[string]*ChainState{"hu": {password: "hp"}})
+	defer httpHop.Close()
+
+	p := &Proxy{Name: "h", Type: "http", Username: "hu", Password: "wrong", Host: "127.0.0.1", Port: httpHop.Addr().(*net.TCPAddr).Port}
+	_, err := connectThrough(t.Context(), []*Proxy{p}, "127.0.0.1", 1)
+	if err == nil || err.Error() != "hop h: auth failed for hop h" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestHTTPHopRejectsUDPAssociate(t *testing.T) {
+	p := &Proxy{Name: "h", Type: "http"}
+	client, server := net.Pipe()
+	defer client.Close()
+	if _, _, err := requestProxy(t.Context(), server, p, 0x03, "0.0.0.0", 0, ioTimeout); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hopHeaders are stripped from requests and responses relayed by the HTTP
+// proxy front-end.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Upgrade",
+}
+
+// handleHTTPConn serves an HTTP proxy client: CONNECT tunnels and plain
+// HTTP requests with absolute URIs. Clients authenticate with
+// Proxy-Authorization Basic against the same users as SOCKS5 clients, or
+// with a TLS client certificate mapped to a user.
+func handleHTTPConn(conn net.Conn, chains map[string]*ChainState, l *Listener) {
+	defer conn.Close()
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetNoDelay(true)
+	}
+	auth := l.authRequired(chains)
+	chains = l.users(chains)
+	certState, ok := handshakeTLS(conn, chains, l)
+	if !ok {
+		return
+	}
+	ic := &idleConn{Conn: conn, timeout: ioTimeout}
+	br := bufio.NewReader(ic)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				warnLog.Printf("http request read: %v", err)
+			}
+			return
+		}
+		ic.timeout = idleTimeout
+		state, ok := certState, true
+		if state == nil && auth {
+			state, ok = httpUser(req, chains)
+		}
+		if !ok {
+			writeHTTPError(conn, http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm=\"socksstrata\"\r\n")
+			return
+		}
+		if req.Method == http.MethodConnect {
+			httpConnect(conn, br, req, state)
+			return
+		}
+		if !httpForward(conn, req, state) {
+			return
+		}
+	}
+}
+
+// httpUser resolves the Proxy-Authorization header to a configured user.
+func httpUser(req *http.Request, chains map[string]*ChainState) (*ChainState, bool) {
+	auth := req.Header.Get("Proxy-Authorization")
+	scheme, cred, ok := strings.Cut(auth, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		warnLog.Printf("http proxy: missing credentials, code 407")
+		return nil, false
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(cred))
+	if err != nil {
+		warnLog.Printf("http proxy: bad credentials encoding, code 407")
+		return nil, false
+	}
+	uname, passwd, _ := strings.Cut(string(raw), ":")
+	st, ok := chains[uname]
+	if !ok || st.password != passwd {
+		warnLog.Printf("authentication failed for user %s, code 407", uname)
+		return nil, false
+	}
+	return st, true
+}
+
+func httpConnect(conn net.Conn, br *bufio.Reader, req *http.Request, state *ChainState) {
+	host, portStr, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		warnLog.Printf("http connect: bad target %q, code 400", req.Host)
+		writeHTTPError(conn, http.StatusBadRequest, "")
+		return
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		warnLog.Printf("http connect: bad port %q, code 400", portStr)
+		writeHTTPError(conn, http.StatusBadRequest, "")
+		return
+	}
+	debugLog.Printf("http connect request to %s", req.Host)
+	ctx, cancel := context.WithTimeout(clientContext(conn), ioTimeout)
+	defer cancel()
+	target, rule := route(ctx, state, host, port)
+	if rule.rejects() {
+		warnLog.Printf("connect to %s rejected by rules[%d], code 403", req.Host, rule.index)
+		writeHTTPError(conn, http.StatusForbidden, "")
+		return
+	}
+	if rule.blackholes() {
+		debugLog.Printf("connect to %s blackholed by rules[%d]", req.Host, rule.index)
+		conn.SetDeadline(time.Now().Add(ioTimeout))
+		if err := writeFull(conn, []byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+			warnLog.Printf("write: %v", err)
+			return
+		}
+		blackhole(conn)
+		return
+	}
+	if target != nil {
+		target.acquire()
+		defer target.release()
+	}
+	remote, err := dialTarget(ctx, target, host, port)
+	if err != nil {
+		warnLog.Printf("connect to %s failed: %v, code 502", req.Host, err)
+		writeHTTPError(conn, http.StatusBadGateway, "")
+		return
+	}
+	if tcp, ok := remote.(*net.TCPConn); ok {
+		tcp.SetNoDelay(true)
+	}
+	defer remote.Close()
+	conn.SetDeadline(time.Now().Add(ioTimeout))
+	if err := writeFull(conn, []byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		warnLog.Printf("write: %v", err)
+		return
+	}
+	if n := br.Buffered(); n > 0 {
+		early, _ := br.Peek(n)
+		remote.SetDeadline(time.Now().Add(ioTimeout))
+		if err := writeFull(remote, early); err != nil {
+			warnLog.Printf("write: %v", err)
+			return
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	remote.SetDeadline(time.Time{})
+	proxy(remote, conn)
+}
+
+// httpForward relays one plain HTTP request and its response. It reports
+// whether the client connection can be reused for another request.
+func httpForward(conn net.Conn, req *http.Request, state *ChainState) bool {
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		warnLog.Printf("http proxy: unsupported request URI %q, code 400", req.RequestURI)
+		writeHTTPError(conn, http.StatusBadRequest, "")
+		return false
+	}
+	host := req.URL.Hostname()
+	port := 80
+	if p := req.URL.Port(); p != "" {
+		var err error
+		port, err = strconv.Atoi(p)
+		if err != nil || port <= 0 || port > 65535 {
+			warnLog.Printf("http proxy: bad port %q, code 400", p)
+			writeHTTPError(conn, http.StatusBadRequest, "")
+			return false
+		}
+	}
+	debugLog.Printf("http request %s %s", req.Method, req.URL)
+	ctx, cancel := context.WithTimeout(clientContext(conn), ioTimeout)
+	defer cancel()
+	target, rule := route(ctx, state, host, port)
+	if rule.rejects() {
+		warnLog.Printf("request to %s rejected by rules[%d], code 403", req.URL.Host, rule.index)
+		writeHTTPError(conn, http.StatusForbidden, "")
+		return false
+	}
+	if rule.blackholes() {
+		debugLog.Printf("request to %s blackholed by rules[%d]", req.URL.Host, rule.index)
+		blackhole(conn)
+		return false
+	}
+	if target != nil {
+		target.acquire()
+		defer target.release()
+	}
+	remote, err := dialTarget(ctx, target, host, port)
+	if err != nil {
+		warnLog.Printf("connect to %s failed: %v, code 502", req.URL.Host, err)
+		writeHTTPError(conn, http.StatusBadGateway, "")
+		return false
+	}
+	defer remote.Close()
+	keepAlive := !req.Close
+	removeHopHeaders(req.Header)
+	req.Close = true
+	rc := &idleConn{Conn: remote, timeout: idleTimeout}
+	if err := req.Write(rc); err != nil {
+		warnLog.Printf("http request write: %v, code 502", err)
+		writeHTTPError(conn, http.StatusBadGateway, "")
+		return false
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(rc), req)
+	if err != nil {
+		warnLog.Printf("http response read: %v, code 502", err)
+		writeHTTPError(conn, http.StatusBadGateway, "")
+		return false
+	}
+	defer resp.Body.Close()
+	removeHopHeaders(resp.Header)
+	resp.Close = !keepAlive
+	if err := resp.Write(&idleConn{Conn: conn, timeout: idleTimeout}); err != nil {
+		warnLog.Printf("http response write: %v", err)
+		return false
+	}
+	return !resp.Close
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, f := range h.Values("Connection") {
+		for _, name := range strings.Split(f, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+func writeHTTPError(conn net.Conn, code int, extra string) {
+	resp := fmt.Sprintf("HTTP/1.1 %d %s\r\n%sContent-Length: 0\r\nConnection: close\r\n\r\n", code, http.StatusText(code), extra)
+	conn.SetDeadline(time.Now().Add(ioTimeout))
+	if err := writeFull(conn, []byte(resp)); err != nil {
+		warnLog.Printf("write: %v", err)
+	}
+}
+
+// idleConn pushes the deadline forward on every read and write so that
+// only inactivity, not total transfer time, is bounded.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHandleHTTPConnConnect(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog = origWarn, origDebug }()
+
+	ln := startPongServer(t)
+	defer ln.Close()
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() { handleHTTPConn(server, nil, &Listener{}); close(done) }()
+
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", ln.Addr(), ln.Addr())
+	if _, err := client.Write([]byte(req)); err != nil {
+		t.Fatalf("connect write: %v", err)
+	}
+	br := bufio.NewReader(client)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("connect read: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatalf("data write: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		t.Fatalf("data read: %v", err)
+	}
+	if string(buf) != "pong" {
+		t.Fatalf("unexpected data %q", buf)
+	}
+	client.Close()
+	<-done
+}
+
+func TestHandleHTTPConnAuthRequired(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog = origWarn, origDebug }()
+
+	chains := map[string]*ChainState{"user": {password: "pass"}}
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() { handleHTTPConn(server, chains, &Listener{}); close(done) }()
+
+	bad := base64.StdEncoding.EncodeToString([]byte("user:wrong"))
+	req := "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nProxy-Authorization: Basic " + bad + "\r\n\r\n"
+	if _, err := client.Write([]byte(req)); err != nil {
+		t.Fatalf("connect write: %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("expected 407, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Proxy-Authenticate") == "" {
+		t.Fatal("expected Proxy-Authenticate header")
+	}
+	<-done
+	client.Close()
+}
+
+func TestHandleHTTPConnForward(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog = origWarn, origDebug }()
+
+	var gotAuth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Proxy-Authorization")
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	}))
+	defer srv.Close()
+
+	chains := map[string]*ChainState{"user": {password: "pass"}}
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() { handleHTTPConn(server, chains, &Listener{}); close(done) }()
+
+	cred := base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	br := bufio.NewReader(client)
+	for _, path := range []string{"/a", "/b"} {
+		req := fmt.Sprintf("GET %s%s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: Basic %s\r\n\r\n", srv.URL, path, srv.Listener.Addr(), cred)
+		if _, err := client.Write([]byte(req)); err != nil {
+			t.Fatalf("request write: %v", err)
+		}
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("response read: %v", err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("body read: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK || string(body) != "hello "+path {
+			t.Fatalf("unexpected response %d %q", resp.StatusCode, body)
+		}
+		if gotAuth != "" {
+			t.Fatalf("Proxy-Authorization leaked upstream: %q", gotAuth)
+		}
+	}
+	client.Close()
+	<-done
+}
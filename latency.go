@@ -0,0 +1,45 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// latencyAlpha weights a new sample in the latency moving average.
+const latencyAlpha = 0.3
+
+// latencyExplore is the fraction of selections that try a random proxy
+// first so that its latency is measured again.
+var latencyExplore = 0.05
+
+// observeLatency folds a connect and handshake time into the exponentially
+// weighted moving average of p.
+func (p *Proxy) observeLatency(d time.Duration) {
+	if d <= 0 {
+		d = 1
+	}
+	for {
+		old := p.latency.Load()
+		next := int64(d)
+		if old > 0 {
+			next = old + int64(latencyAlpha*float64(int64(d)-old))
+		}
+		if p.latency.CompareAndSwap(old, next) {
+			return
+		}
+	}
+}
+
+// orderByLatency sorts proxies by their average latency. Proxies that have
+// not been measured yet come first.
+func orderByLatency(proxies []*Proxy) []*Proxy {
+	sort.SliceStable(proxies, func(i, j int) bool {
+		return proxies[i].latency.Load() < proxies[j].latency.Load()
+	})
+	if len(proxies) > 1 && rand.Float64() < latencyExplore {
+		i := 1 + rand.Intn(len(proxies)-1)
+		proxies[0], proxies[i] = proxies[i], proxies[0]
+	}
+	return proxies
+}
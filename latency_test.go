@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestObserveLatency(t *testing.T) {
+	p := &Proxy{}
+	p.observeLatency(100 * time.Millisecond)
+	if got := time.Duration(p.latency.Load()); got != 100*time.Millisecond {
+		t.Fatalf("first sample: got %v", got)
+	}
+	p.observeLatency(200 * time.Millisecond)
+	if got := time.Duration(p.latency.Load()); got != 130*time.Millisecond {
+		t.Fatalf("second sample: got %v", got)
+	}
+}
+
+func TestLatencyStrategy(t *testing.T) {
+	orig := latencyExplore
+	latencyExplore = 0
+	defer func() { latencyExplore = orig }()
+
+	slow := &Proxy{Name: "slow", Host: "h1", Port: 1}
+	fast := &Proxy{Name: "fast", Host: "h2", Port: 2}
+	fresh := &Proxy{Name: "fresh", Host: "h3", Port: 3}
+	cfg := Config{Chains: []UserChain{{Chain: []*Hop{{Strategy: "latency", Proxies: []*Proxy{slow, fast, fresh}}}}}}
+	initProxies(&cfg)
+	slow.observeLatency(300 * time.Millisecond)
+	fast.observeLatency(20 * time.Millisecond)
+	hop := cfg.Chains[0].Chain[0]
+
+	res := hop.orderedProxies(dialInfo{})
+	if len(res) != 3 || res[0] != fresh || res[1] != fast || res[2] != slow {
+		t.Fatalf("unexpected order: %v", res)
+	}
+	fresh.observeLatency(time.Second)
+	res = hop.orderedProxies(dialInfo{})
+	if res[0] != fast || res[2] != fresh {
+		t.Fatalf("unexpected order after measuring: %v", res)
+	}
+
+	latencyExplore = 1
+	explored := false
+	for i := 0; i < 20 && !explored; i++ {
+		explored = hop.orderedProxies(dialInfo{})[0] != fast
+	}
+	if !explored {
+		t.Fatal("exploration never tried another proxy")
+	}
+}
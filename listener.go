@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// effectiveListeners returns the configured listeners, or the SOCKS5 and
+// HTTP listeners described by the general section when none are given.
+func (cfg *Config) effectiveListeners() []*Listener {
+	if len(cfg.Listeners) > 0 {
+		return cfg.Listeners
+	}
+	g := cfg.General
+	ls := []*Listener{{
+		Address:  net.JoinHostPort(g.Bind, strconv.Itoa(g.Port)),
+		Protocol: "socks5",
+		TLS:      g.TLS,
+		Socks4:   g.Socks4,
+	}}
+	if g.HTTPPort > 0 {
+		ls = append(ls, &Listener{
+			Address:  net.JoinHostPort(g.Bind, strconv.Itoa(g.HTTPPort)),
+			Protocol: "http",
+		})
+	}
+	return ls
+}
+
+func validateListeners(cfg *Config) error {
+	seen := make(map[string]bool)
+	for i, l := range cfg.Listeners {
+		if l == nil {
+			return fmt.Errorf("listeners[%d]: empty entry", i)
+		}
+		if path, ok := unixPath(l.Address); ok {
+			if err := validateUnixListener(l, path); err != nil {
+				return fmt.Errorf("listeners[%d]: %w", i, err)
+			}
+		} else {
+			_, portStr, err := net.SplitHostPort(l.Address)
+			if err != nil {
+				return fmt.Errorf("listeners[%d]: invalid address %q", i, l.Address)
+			}
+			if port, err := strconv.Atoi(portStr); err != nil || port <= 0 || port > 65535 {
+				return fmt.Errorf("listeners[%d]: port must be between 1 and 65535", i)
+			}
+			if l.Mode != "" || l.Owner != "" {
+				return fmt.Errorf("listeners[%d]: mode and owner require a unix:// address", i)
+			}
+		}
+		if seen[l.Address] {
+			return fmt.Errorf("listeners[%d]: duplicate address %q", i, l.Address)
+		}
+		seen[l.Address] = true
+		switch strings.ToLower(l.Protocol) {
+		case "", "socks5", "socks4", "http", "redirect", "tproxy":
+		default:
+			return fmt.Errorf("listeners[%d]: invalid protocol %q", i, l.Protocol)
+		}
+		switch strings.ToLower(l.Auth) {
+		case "", "none", "required":
+		default:
+			return fmt.Errorf("listeners[%d]: invalid auth %q", i, l.Auth)
+		}
+		if err := validateListenerTLS(l.TLS); err != nil {
+			return fmt.Errorf("listeners[%d].%w", i, err)
+		}
+		if err := validateProxyProtocol(l.ProxyProtocol); err != nil {
+			return fmt.Errorf("listeners[%d].%w", i, err)
+		}
+		if err := validateTransparent(l, cfg.Chains); err != nil {
+			return fmt.Errorf("listeners[%d]: %w", i, err)
+		}
+		for _, name := range l.AllowedUsers {
+			if !hasUser(cfg.Chains, name) {
+				return fmt.Errorf("listeners[%d]: allowed user %q is not configured", i, name)
+			}
+		}
+	}
+	return nil
+}
+
+func hasUser(chains []UserChain, name string) bool {
+	for _, uc := range chains {
+		if uc.Username == name {
+			return true
+		}
+	}
+	return false
+}
+
+// protocol returns the normalized protocol of l.
+func (l *Listener) protocol() string {
+	if l.Protocol == "" {
+		return "socks5"
+	}
+	return strings.ToLower(l.Protocol)
+}
+
+// listen opens the socket for l. The PROXY protocol header, when enabled,
+// precedes the TLS handshake.
+func (l *Listener) listen() (net.Listener, error) {
+	var ln net.Listener
+	var err error
+	if path, ok := unixPath(l.Address); ok {
+		ln, err = listenUnix(path, l.Mode, l.Owner)
+	} else if l.protocol() == "tproxy" {
+		lc := net.ListenConfig{Control: transparentControl}
+		ln, err = lc.Listen(context.Background(), "tcp", l.Address)
+	} else {
+		ln, err = net.Listen("tcp", l.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p := l.ProxyProtocol; p != nil && p.Enabled {
+		trusted, err := parseCIDRs(p.Trusted)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		ln = &proxyProtoListener{Listener: ln, trusted: trusted}
+	}
+	if l.TLS != nil && l.TLS.Enabled {
+		conf, err := buildListenerTLS(l.TLS)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		ln = tls.NewListener(ln, conf)
+	}
+	return ln, nil
+}
+
+// handler returns the connection handler for the protocol of l.
+func (l *Listener) handler() func(net.Conn, map[string]*ChainState, *Listener) {
+	switch {
+	case l.protocol() == "http":
+		return handleHTTPConn
+	case l.isTransparent():
+		return handleTransparent
+	}
+	return handleConn
+}
+
+// authRequired reports whether clients of l must authenticate. Unless set
+// explicitly, authentication is required whenever users are configured.
+func (l *Listener) authRequired(chains map[string]*ChainState) bool {
+	switch strings.ToLower(l.Auth) {
+	case "none":
+		return false
+	case "required":
+		return true
+	}
+	return len(chains) > 0
+}
+
+// users returns the subset of chains that may authenticate on l.
+func (l *Listener) users(chains map[string]*ChainState) map[string]*ChainState {
+	if len(l.AllowedUsers) == 0 {
+		return chains
+	}
+	allowed := make(map[string]*ChainState, len(l.AllowedUsers))
+	for _, name := range l.AllowedUsers {
+		if st, ok := chains[name]; ok {
+			allowed[name] = st
+		}
+	}
+	return allowed
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestValidateListeners(t *testing.T) {
+	chains := []UserChain{{Username: "alice", Password: "pass"}}
+	tests := []struct {
+		name    string
+		general General
+		ls      []*Listener
+	}{
+		{name: "missing port", ls: []*Listener{{Address: "127.0.0.1"}}},
+		{name: "bad port", ls: []*Listener{{Address: "127.0.0.1:70000"}}},
+		{name: "duplicate", ls: []*Listener{{Address: ":1080"}, {Address: ":1080", Protocol: "http"}}},
+		{name: "bad protocol", ls: []*Listener{{Address: ":1080", Protocol: "ftp"}}},
+		{name: "bad auth", ls: []*Listener{{Address: ":1080", Auth: "maybe"}}},
+		{name: "unknown allowed user", ls: []*Listener{{Address: ":1080", AllowedUsers: []string{"bob"}}}},
+		{name: "tls without cert", ls: []*Listener{{Address: ":1080", TLS: &ListenerTLS{Enabled: true}}}},
+		{name: "combined with general", general: General{Port: 1080}, ls: []*Listener{{Address: ":1081"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := tt.general
+			g.HealthCheckInterval = time.Second
+			g.ChainCleanupInterval = time.Second
+			g.HealthCheckTimeout = time.Second
+			g.HealthCheckConcurrent = 1
+			g.IOTimeout = time.Second
+			g.IdleTimeout = time.Minute
+			g.MaxConnections = 1
+			cfg := Config{General: g, Listeners: tt.ls, Chains: chains}
+			if err := validateConfig(&cfg); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestEffectiveListenersLegacy(t *testing.T) {
+	cfg := Config{General: General{Bind: "127.0.0.1", Port: 1080, HTTPPort: 8080, Socks4: true}}
+	ls := cfg.effectiveListeners()
+	if len(ls) != 2 {
+		t.Fatalf("expected 2 listeners, got %d", len(ls))
+	}
+	if ls[0].Address != "127.0.0.1:1080" || ls[0].protocol() != "socks5" || !ls[0].Socks4 {
+		t.Fatalf("unexpected socks listener %+v", ls[0])
+	}
+	if ls[1].Address != "127.0.0.1:8080" || ls[1].protocol() != "http" {
+		t.Fatalf("unexpected http listener %+v", ls[1])
+	}
+}
+
+// listenerHandshake sends req to handleConn on l and checks the reply.
+func listenerHandshake(t *testing.T, l *Listener, chains map[string]*ChainState, req, want []byte) {
+	t.Helper()
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog = origWarn, origDebug }()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleConn(server, chains, l)
+	// The server may stop reading before the whole request is written.
+	go client.Write(req)
+	resp := make([]byte, len(want))
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(client, resp); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(resp, want) {
+		t.Fatalf("unexpected response %v, want %v", resp, want)
+	}
+}
+
+func TestListenerAllowedUsers(t *testing.T) {
+	chains := map[string]*ChainState{"alice": {password: "pass"}, "bob": {password: "pass"}}
+	l := &Listener{AllowedUsers: []string{"alice"}}
+	req := []byte{0x05, 0x01, 0x02, 0x01, 3, 'b', 'o', 'b', 4, 'p', 'a', 's', 's'}
+	listenerHandshake(t, l, chains, req, []byte{0x05, 0x02, 0x01, 0x01})
+	req = []byte{0x05, 0x01, 0x02, 0x01, 5, 'a', 'l', 'i', 'c', 'e', 4, 'p', 'a', 's', 's'}
+	listenerHandshake(t, l, chains, req, []byte{0x05, 0x02, 0x01, 0x00})
+}
+
+func TestListenerAuthRequired(t *testing.T) {
+	listenerHandshake(t, &Listener{Auth: "required"}, nil, []byte{0x05, 0x01, 0x00}, []byte{0x05, 0xFF})
+}
+
+func TestListenerAuthNone(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog = origWarn, origDebug }()
+
+	target := startPongServer(t)
+	defer target.Close()
+
+	chains := map[string]*ChainState{"alice": {password: "pass"}}
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleConn(server, chains, &Listener{Auth: "none"})
+	if code := socks5Connect(t, client, "", "", target.Addr().(*net.TCPAddr)); code != 0x00 {
+		t.Fatalf("expected success, got 0x%02X", code)
+	}
+	pingPong(t, client)
+}
+
+func TestListenerSocks4Only(t *testing.T) {
+	listenerHandshake(t, &Listener{Protocol: "socks4"}, nil, []byte{0x05, 0x01, 0x00}, []byte{0x05, 0xFF})
+}
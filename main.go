@@ -10,7 +10,7 @@ import (
 	"net"
 	"os"
 	"os/signal"
-	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -22,7 +22,7 @@ func buildUserChains(chains []UserChain) (map[string]*ChainState, error) {
 		if _, ok := userChains[uc.Username]; ok {
 			return nil, fmt.Errorf("duplicate username %q", uc.Username)
 		}
-		userChains[uc.Username] = &ChainState{chain: uc.Chain, password: uc.Password}
+		userChains[uc.Username] = &ChainState{name: uc.Username, chain: uc.Chain, password: uc.Password}
 	}
 	return userChains, nil
 }
@@ -38,17 +38,46 @@ func main() {
 	}
 	ioTimeout = cfg.General.IOTimeout
 	idleTimeout = cfg.General.IdleTimeout
-	initProxies(&cfg)
-	initLoggers(cfg.General.LogLevel, cfg.General.LogFormat)
-	addr := net.JoinHostPort(cfg.General.Bind, strconv.Itoa(cfg.General.Port))
-	ln, err := net.Listen("tcp", addr)
-	if err != nil {
+	bindTimeout = cfg.General.BindTimeout
+	chainCacheSize = cfg.General.ChainCacheSize
+	chainCacheTTL = cfg.General.ChainCleanupInterval
+	raceDelay = cfg.General.RaceDelay
+	raceConcurrency = cfg.General.RaceConcurrency
+	chainMaxAttempts = cfg.General.ChainMaxAttempts
+	chainDialTimeout = cfg.General.ChainDialTimeout
+	breakerSettings = cfg.General.CircuitBreaker.withDefaults()
+	healthCheckMode = strings.ToLower(cfg.General.HealthCheckMode)
+	healthCheckTarget = cfg.General.HealthCheckTarget
+	healthCheckSend = cfg.General.HealthCheckSend
+	healthCheckExpect = cfg.General.HealthCheckExpect
+	slowStart = cfg.General.SlowStart
+	rulesResolve.Store(cfg.General.RulesResolve)
+	if err := initGeoIP(cfg.General); err != nil {
 		log.Fatal(err)
 	}
+	if err := initProxies(&cfg); err != nil {
+		log.Fatal(err)
+	}
+	initLoggers(cfg.General.LogLevel, cfg.General.LogFormat)
+	type boundListener struct {
+		ln  net.Listener
+		cfg *Listener
+	}
+	var listeners []boundListener
+	for _, l := range cfg.effectiveListeners() {
+		ln, err := l.listen()
+		if err != nil {
+			log.Fatal(err)
+		}
+		listeners = append(listeners, boundListener{ln, l})
+		infoLog.Printf("%s listening on %s", l.protocol(), ln.Addr())
+	}
 
 	defer func() {
-		if err := ln.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
-			warnLog.Printf("listener close: %v", err)
+		for _, l := range listeners {
+			if err := l.ln.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+				warnLog.Printf("listener close: %v", err)
+			}
 		}
 	}()
 
@@ -61,8 +90,10 @@ func main() {
 	go func() {
 		<-sigCh
 		cancel()
-		if err := ln.Close(); err != nil {
-			warnLog.Printf("listener close: %v", err)
+		for _, l := range listeners {
+			if err := l.ln.Close(); err != nil {
+				warnLog.Printf("listener close: %v", err)
+			}
 		}
 		wg.Wait()
 		close(done)
@@ -70,21 +101,33 @@ func main() {
 
 	sem := make(chan struct{}, cfg.General.MaxConnections)
 
-	infoLog.Printf("listening on %s", addr)
 	ucMap, err := buildUserChains(cfg.Chains)
 	if err != nil {
 		log.Fatal(err)
 	}
 	userChains.Store(ucMap)
+	installRouting(ctx, &cfg)
 	startHealthChecks(ctx, &cfg)
 	startChainCacheCleanup(ctx, cfg.General.ChainCleanupInterval)
 	startConfigReload(ctx, &cfg)
+	startGeoIPReload(ctx, cfg.General.GeoIPReloadInterval)
+	for _, l := range listeners {
+		go serve(ctx, l.ln, l.cfg, sem, &wg)
+	}
+	<-done
+}
+
+// serve accepts connections from ln until ctx is cancelled and hands each
+// one to the handler for the protocol of l. sem bounds the number of
+// connections across listeners.
+func serve(ctx context.Context, ln net.Listener, l *Listener, sem chan struct{}, wg *sync.WaitGroup) {
+	handle := l.handler()
 	for {
 		c, err := ln.Accept()
 		if err != nil {
 			select {
 			case <-ctx.Done():
-				break
+				return
 			default:
 			}
 			warnLog.Printf("accept: %v", err)
@@ -95,21 +138,26 @@ func main() {
 		}
 		select {
 		case sem <- struct{}{}:
-			if ra, ok := c.RemoteAddr().(*net.TCPAddr); ok {
-				infoLog.Printf("client connected: %s", ra.IP)
-			} else {
-				infoLog.Printf("client connected: %s", c.RemoteAddr())
-			}
 			wg.Add(1)
 			go func() {
 				defer func() { <-sem }()
 				defer wg.Done()
-				handleConn(c, userChains.Load().(map[string]*ChainState))
+				// RemoteAddr may have to read a PROXY protocol header.
+				c.SetDeadline(time.Now().Add(ioTimeout))
+				if ra, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+					infoLog.Printf("client connected: %s", ra.IP)
+				} else {
+					infoLog.Printf("client connected: %s", c.RemoteAddr())
+				}
+				handle(c, userChains.Load().(map[string]*ChainState), l)
 			}()
 		default:
-			warnLog.Printf("too many connections; closing %s", c.RemoteAddr())
-			c.Close()
+			// Logged off the accept loop since RemoteAddr may block.
+			go func() {
+				c.SetDeadline(time.Now().Add(ioTimeout))
+				warnLog.Printf("too many connections; closing %s", c.RemoteAddr())
+				c.Close()
+			}()
 		}
 	}
-	<-done
 }
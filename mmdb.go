@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"os"
+)
+
+// mmdbMetadataMarker starts the metadata section at the end of a MaxMind
+// DB file.
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+var errMMDBCorrupt = errors.New("mmdb: invalid database")
+
+// mmdbReader looks up addresses in a MaxMind DB file read into memory. See
+// https://maxmind.github.io/MaxMind-DB/ for the format.
+type mmdbReader struct {
+	databaseType string
+	ipVersion    int
+	nodeCount    int
+	recordSize   int
+	nodeSize     int
+	ipv4Start    int
+	tree         []byte
+	data         []byte
+}
+
+func openMMDB(path string) (*mmdbReader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newMMDBReader(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, nil
+}
+
+func newMMDBReader(buf []byte) (*mmdbReader, error) {
+	metaStart := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if metaStart < 0 {
+		return nil, fmt.Errorf("mmdb: metadata not found")
+	}
+	v, _, err := decodeMMDB(buf[metaStart+len(mmdbMetadataMarker):], 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("mmdb: metadata: %w", err)
+	}
+	meta, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("mmdb: metadata is not a map")
+	}
+	r := &mmdbReader{}
+	r.databaseType, _ = meta["database_type"].(string)
+	nodeCount, _ := meta["node_count"].(uint64)
+	recordSize, _ := meta["record_size"].(uint64)
+	ipVersion, _ := meta["ip_version"].(uint64)
+	r.nodeCount, r.recordSize, r.ipVersion = int(nodeCount), int(recordSize), int(ipVersion)
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("mmdb: unsupported record size %d", r.recordSize)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("mmdb: unsupported IP version %d", r.ipVersion)
+	}
+	r.nodeSize = r.recordSize / 4
+	treeSize := r.nodeCount * r.nodeSize
+	// The search tree is followed by 16 zero bytes, then the data section.
+	if r.nodeCount <= 0 || treeSize+16 > metaStart {
+		return nil, errMMDBCorrupt
+	}
+	r.tree = buf[:treeSize]
+	r.data = buf[treeSize+16 : metaStart]
+	if r.ipVersion == 6 {
+		// IPv4 addresses live under ::/96.
+		for i := 0; i < 96 && r.ipv4Start < r.nodeCount; i++ {
+			r.ipv4Start = r.record(r.ipv4Start, 0)
+		}
+	}
+	return r, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (r *mmdbReader) record(node, bit int) int {
+	b := r.tree[node*r.nodeSize:]
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+	case 28:
+		if bit == 0 {
+			return int(b[3]&0xF0)<<20 | int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+		}
+		return int(b[3]&0x0F)<<24 | int(b[4])<<16 | int(b[5])<<8 | int(b[6])
+	}
+	return int(binary.BigEndian.Uint32(b[bit*4:]))
+}
+
+// lookup returns the record for ip, or nil when the database has none.
+func (r *mmdbReader) lookup(ip net.IP) (any, error) {
+	node, bits := 0, 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+		if r.ipVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if r.ipVersion == 4 {
+		return nil, nil
+	} else if ip = ip.To16(); ip == nil {
+		return nil, fmt.Errorf("mmdb: invalid address")
+	}
+	for i := 0; i < bits && node < r.nodeCount; i++ {
+		node = r.record(node, int(ip[i/8]>>(7-i%8))&1)
+	}
+	switch {
+	case node == r.nodeCount:
+		return nil, nil
+	case node < r.nodeCount:
+		return nil, errMMDBCorrupt
+	}
+	v, _, err := decodeMMDB(r.data, node-r.nodeCount-16, 0)
+	return v, err
+}
+
+// decodeMMDB decodes the data field at off in section, returning it and
+// the offset following it. Maps decode to map[string]any, arrays to []any,
+// unsigned integers up to 64 bits to uint64 and larger ones to *big.Int.
+func decodeMMDB(section []byte, off, depth int) (any, int, error) {
+	if depth > 32 || off < 0 || off >= len(section) {
+		return nil, 0, errMMDBCorrupt
+	}
+	ctrl := section[off]
+	off++
+	typ := int(ctrl >> 5)
+	if typ == 1 {
+		// Pointers hold an offset into the section; decoding continues
+		// after the pointer, not after the data it points to.
+		n := int(ctrl>>3&3) + 1
+		if off+n > len(section) {
+			return nil, 0, errMMDBCorrupt
+		}
+		b := section[off : off+n]
+		var ptr int
+		switch n {
+		case 1:
+			ptr = int(ctrl&7)<<8 | int(b[0])
+		case 2:
+			ptr = int(ctrl&7)<<16 | int(b[0])<<8 | int(b[1]) + 2048
+		case 3:
+			ptr = int(ctrl&7)<<24 | int(b[0])<<16 | int(b[1])<<8 | int(b[2]) + 526336
+		default:
+			ptr = int(binary.BigEndian.Uint32(b))
+		}
+		v, _, err := decodeMMDB(section, ptr, depth+1)
+		return v, off + n, err
+	}
+	if typ == 0 {
+		if off >= len(section) {
+			return nil, 0, errMMDBCorrupt
+		}
+		typ = 7 + int(section[off])
+		off++
+	}
+	size := int(ctrl & 0x1F)
+	if size >= 29 {
+		n := size - 28
+		if off+n > len(section) {
+			return nil, 0, errMMDBCorrupt
+		}
+		ext := 0
+		for _, c := range section[off : off+n] {
+			ext = ext<<8 | int(c)
+		}
+		off += n
+		size = []int{29, 285, 65821}[n-1] + ext
+	}
+	payload := func() ([]byte, error) {
+		if off+size > len(section) {
+			return nil, errMMDBCorrupt
+		}
+		return section[off : off+size], nil
+	}
+	switch typ {
+	case 2, 4: // string, bytes
+		b, err := payload()
+		if err != nil {
+			return nil, 0, err
+		}
+		if typ == 2 {
+			return string(b), off + size, nil
+		}
+		return bytes.Clone(b), off + size, nil
+	case 3, 15: // double, float
+		b, err := payload()
+		if err != nil {
+			return nil, 0, err
+		}
+		switch {
+		case typ == 3 && size == 8:
+			return math.Float64frombits(binary.BigEndian.Uint64(b)), off + size, nil
+		case typ == 15 && size == 4:
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), off + size, nil
+		}
+		return nil, 0, errMMDBCorrupt
+	case 5, 6, 9, 10: // uint16, uint32, uint64, uint128
+		b, err := payload()
+		if err != nil {
+			return nil, 0, err
+		}
+		if size > 8 {
+			if typ != 10 || size > 16 {
+				return nil, 0, errMMDBCorrupt
+			}
+			return new(big.Int).SetBytes(b), off + size, nil
+		}
+		var u uint64
+		for _, c := range b {
+			u = u<<8 | uint64(c)
+		}
+		return u, off + size, nil
+	case 8: // int32
+		b, err := payload()
+		if err != nil || size > 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		var u uint32
+		for _, c := range b {
+			u = u<<8 | uint32(c)
+		}
+		if size > 0 {
+			// Sign-extend from the stored width.
+			shift := 32 - 8*size
+			return int64(int32(u<<shift) >> shift), off + size, nil
+		}
+		return int64(0), off, nil
+	case 7: // map
+		m := make(map[string]any, min(size, 64))
+		for range size {
+			k, next, err := decodeMMDB(section, off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errMMDBCorrupt
+			}
+			var v any
+			if v, off, err = decodeMMDB(section, next, depth+1); err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+		}
+		return m, off, nil
+	case 11: // array
+		a := make([]any, 0, min(size, 64))
+		for range size {
+			v, next, err := decodeMMDB(section, off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			off = next
+		}
+		return a, off, nil
+	case 14: // boolean, held in the size
+		return size != 0, off, nil
+	}
+	return nil, 0, fmt.Errorf("mmdb: unsupported data type %d", typ)
+}
+
+// mmdbField returns the value at path in a decoded record, or nil.
+func mmdbField(v any, path ...string) any {
+	for _, key := range path {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	return v
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// encodeMMDB encodes v in the MaxMind DB data format. It supports the
+// types the tests need: strings, unsigned integers, booleans, maps and
+// arrays.
+func encodeMMDB(v any) []byte {
+	head := func(typ, size int) []byte {
+		var b []byte
+		var ext []byte
+		switch {
+		case size < 29:
+		case size < 285:
+			ext, size = []byte{byte(size - 29)}, 29
+		default:
+			ext, size = []byte{byte((size - 285) >> 8), byte(size - 285)}, 30
+		}
+		if typ < 8 {
+			b = []byte{byte(typ<<5 | size)}
+		} else {
+			b = []byte{byte(size), byte(typ - 7)}
+		}
+		return append(b, ext...)
+	}
+	uint := func(typ int, u uint64) []byte {
+		var b []byte
+		for ; u > 0; u >>= 8 {
+			b = append([]byte{byte(u)}, b...)
+		}
+		return append(head(typ, len(b)), b...)
+	}
+	switch v := v.(type) {
+	case string:
+		return append(head(2, len(v)), v...)
+	case uint16:
+		return uint(5, uint64(v))
+	case uint32:
+		return uint(6, uint64(v))
+	case uint64:
+		return uint(9, v)
+	case bool:
+		size := 0
+		if v {
+			size = 1
+		}
+		return head(14, size)
+	case map[string]any:
+		b := head(7, len(v))
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			b = append(b, encodeMMDB(k)...)
+			b = append(b, encodeMMDB(v[k])...)
+		}
+		return b
+	case []any:
+		b := head(11, len(v))
+		for _, e := range v {
+			b = append(b, encodeMMDB(e)...)
+		}
+		return b
+	}
+	panic("encodeMMDB: unsupported type")
+}
+
+// buildMMDB returns a database mapping each network to its record. IPv4
+// networks in an IPv6 database are stored under ::/96.
+func buildMMDB(t *testing.T, ipVersion, recordSize int, networks map[string]map[string]any) []byte {
+	t.Helper()
+	type node struct{ rec [2]int } // >0: child node, <0: -(data index+1), 0: empty
+	nodes := []node{{}}
+	var data [][]byte
+	cidrs := make([]string, 0, len(networks))
+	for c := range networks {
+		cidrs = append(cidrs, c)
+	}
+	slices.Sort(cidrs)
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			t.Fatalf("cidr %s: %v", c, err)
+		}
+		ones, _ := n.Mask.Size()
+		ip := n.IP
+		if ipVersion == 6 {
+			if ip.To4() != nil {
+				ones += 96
+			}
+			ip = ip.To16()
+			if n.IP.To4() != nil {
+				ip = append(make(net.IP, 12), n.IP.To4()...)
+			}
+		}
+		data = append(data, encodeMMDB(networks[c]))
+		cur := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i/8]>>(7-i%8)) & 1
+			if i == ones-1 {
+				nodes[cur].rec[bit] = -len(data)
+				break
+			}
+			if nodes[cur].rec[bit] <= 0 {
+				nodes = append(nodes, node{})
+				nodes[cur].rec[bit] = len(nodes) - 1
+			}
+			cur = nodes[cur].rec[bit]
+		}
+	}
+	var section []byte
+	offsets := make([]int, len(data))
+	for i, d := range data {
+		offsets[i] = len(section)
+		section = append(section, d...)
+	}
+	count := len(nodes)
+	var tree []byte
+	for _, n := range nodes {
+		var vals [2]uint32
+		for i, r := range n.rec {
+			switch {
+			case r > 0:
+				vals[i] = uint32(r)
+			case r < 0:
+				vals[i] = uint32(count + 16 + offsets[-r-1])
+			default:
+				vals[i] = uint32(count)
+			}
+		}
+		switch recordSize {
+		case 24:
+			tree = append(tree, byte(vals[0]>>16), byte(vals[0]>>8), byte(vals[0]),
+				byte(vals[1]>>16), byte(vals[1]>>8), byte(vals[1]))
+		case 28:
+			tree = append(tree, byte(vals[0]>>16), byte(vals[0]>>8), byte(vals[0]),
+				byte(vals[0]>>24<<4|vals[1]>>24&0x0F), byte(vals[1]>>16), byte(vals[1]>>8), byte(vals[1]))
+		default:
+			tree = binary.BigEndian.AppendUint32(tree, vals[0])
+			tree = binary.BigEndian.AppendUint32(tree, vals[1])
+		}
+	}
+	buf := append(tree, make([]byte, 16)...)
+	buf = append(buf, section...)
+	buf = append(buf, mmdbMetadataMarker...)
+	return append(buf, encodeMMDB(map[string]any{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"database_type":               "Test-Country",
+		"ip_version":                  uint16(ipVersion),
+		"languages":                   []any{"en"},
+		"node_count":                  uint32(count),
+		"record_size":                 uint16(recordSize),
+	})...)
+}
+
+func writeMMDB(t *testing.T, networks map[string]map[string]any) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, buildMMDB(t, 6, 28, networks), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	return path
+}
+
+func TestMMDBLookup(t *testing.T) {
+	networks := map[string]map[string]any{
+		"1.0.0.0/24":     {"country": map[string]any{"iso_code": "AU"}},
+		"1.0.1.0/24":     {"country": map[string]any{"iso_code": "CN"}, "autonomous_system_number": uint32(4134)},
+		"2001:db8::/32":  {"country": map[string]any{"iso_code": "DE"}},
+		"10.128.0.0/9":   {"anycast": true},
+		"203.0.113.7/32": {"list": []any{"a", uint64(1) << 40}},
+	}
+	type lookupTest struct {
+		ip   string
+		want any
+	}
+	for _, v := range []struct{ ipVersion, recordSize int }{{6, 24}, {6, 28}, {6, 32}, {4, 24}} {
+		nets := networks
+		if v.ipVersion == 4 {
+			nets = maps4(networks)
+		}
+		r, err := newMMDBReader(buildMMDB(t, v.ipVersion, v.recordSize, nets))
+		if err != nil {
+			t.Fatalf("v%d/%d: open: %v", v.ipVersion, v.recordSize, err)
+		}
+		tests := []lookupTest{
+			{"1.0.0.200", networks["1.0.0.0/24"]},
+			{"1.0.1.1", networks["1.0.1.0/24"]},
+			{"1.0.2.1", nil},
+			{"10.200.0.1", networks["10.128.0.0/9"]},
+			{"10.1.0.1", nil},
+			{"203.0.113.7", networks["203.0.113.7/32"]},
+			{"203.0.113.8", nil},
+		}
+		if v.ipVersion == 6 {
+			tests = append(tests, lookupTest{"2001:db8::1", networks["2001:db8::/32"]}, lookupTest{"2001:db9::1", nil})
+		} else {
+			tests = append(tests, lookupTest{"2001:db8::1", nil})
+		}
+		for _, tt := range tests {
+			got, err := r.lookup(net.ParseIP(tt.ip))
+			if err != nil {
+				t.Fatalf("v%d/%d %s: %v", v.ipVersion, v.recordSize, tt.ip, err)
+			}
+			if tt.want == nil && got != nil || tt.want != nil && !reflect.DeepEqual(got, normalizeMMDB(tt.want)) {
+				t.Errorf("v%d/%d %s: got %v, want %v", v.ipVersion, v.recordSize, tt.ip, got, tt.want)
+			}
+		}
+	}
+}
+
+// maps4 drops the IPv6 networks.
+func maps4(networks map[string]map[string]any) map[string]map[string]any {
+	out := make(map[string]map[string]any)
+	for c, rec := range networks {
+		if ip, _, _ := net.ParseCIDR(c); ip.To4() != nil {
+			out[c] = rec
+		}
+	}
+	return out
+}
+
+// normalizeMMDB converts v to the types decodeMMDB returns.
+func normalizeMMDB(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, e := range v {
+			out[k] = normalizeMMDB(e)
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			out[i] = normalizeMMDB(e)
+		}
+		return out
+	case uint16:
+		return uint64(v)
+	case uint32:
+		return uint64(v)
+	}
+	return v
+}
+
+func TestDecodeMMDB(t *testing.T) {
+	tests := []struct {
+		name string
+		buf  []byte
+		want any
+	}{
+		{"long string", encodeMMDB(string(bytes.Repeat([]byte("x"), 300))), string(bytes.Repeat([]byte("x"), 300))},
+		{"int32 negative", []byte{0x02, 0x01, 0xFF, 0x85}, int64(-123)},
+		{"int32 empty", []byte{0x00, 0x01}, int64(0)},
+		{"double", []byte{0x68, 0x40, 0x09, 0x21, 0xFB, 0x54, 0x44, 0x2D, 0x18}, 3.141592653589793},
+		{"uint128", []byte{0x09, 0x03, 1, 0, 0, 0, 0, 0, 0, 0, 0}, new(big.Int).Lsh(big.NewInt(1), 64)},
+		{"bool", []byte{0x01, 0x07}, true},
+	}
+	for _, tt := range tests {
+		got, next, err := decodeMMDB(tt.buf, 0, 0)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if next != len(tt.buf) {
+			t.Errorf("%s: decoded %d of %d bytes", tt.name, next, len(tt.buf))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeMMDBPointer(t *testing.T) {
+	key := encodeMMDB("iso_code")
+	// A map whose key is a pointer to the string at offset 0.
+	buf := append(slices.Clone(key), 0xE1, 0x20, 0x00)
+	buf = append(buf, encodeMMDB("CN")...)
+	got, next, err := decodeMMDB(buf, len(key), 0)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if want := map[string]any{"iso_code": "CN"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if next != len(buf) {
+		t.Fatalf("decoded %d of %d bytes", next, len(buf))
+	}
+}
+
+func TestDecodeMMDBCorrupt(t *testing.T) {
+	for _, buf := range [][]byte{
+		{},
+		{0x45, 'a', 'b'},            // string longer than the section
+		{0x20, 0x05},                // pointer past the end
+		{0x20, 0x00},                // pointer to itself
+		{0xE2, 0x41, 'k'},           // map missing its value
+		{0x00, 0x20},                // unknown extended type
+		{0x5D},                      // missing size extension
+		{0xE1, 0x06, 1, 2, 3},       // map with a non-string key
+		{0x05, 0x01, 1, 2, 3, 4, 5}, // int32 wider than 4 bytes
+	} {
+		if v, _, err := decodeMMDB(buf, 0, 0); err == nil {
+			t.Errorf("% x: expected error, got %v", buf, v)
+		}
+	}
+}
+
+func TestNewMMDBReaderInvalid(t *testing.T) {
+	valid := buildMMDB(t, 6, 24, map[string]map[string]any{"1.0.0.0/24": {"a": "b"}})
+	meta := func(m map[string]any) []byte {
+		return append(slices.Clone(mmdbMetadataMarker), encodeMMDB(m)...)
+	}
+	for name, buf := range map[string][]byte{
+		"no metadata":  valid[:bytes.LastIndex(valid, mmdbMetadataMarker)],
+		"record size":  meta(map[string]any{"node_count": uint32(1), "record_size": uint16(20), "ip_version": uint16(6)}),
+		"ip version":   meta(map[string]any{"node_count": uint32(1), "record_size": uint16(24), "ip_version": uint16(5)}),
+		"tree too big": meta(map[string]any{"node_count": uint32(100), "record_size": uint16(24), "ip_version": uint16(6)}),
+	} {
+		if _, err := newMMDBReader(buf); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Pool is a named group of the top-level proxies that hops can use with
+// pool: <name> instead of listing proxies themselves.
+type Pool struct {
+	Name    string   `yaml:"name"`
+	Proxies []string `yaml:"proxies"`
+}
+
+func validatePools(cfg *Config) error {
+	proxies := make(map[string]bool)
+	for i, p := range cfg.Proxies {
+		if p.Name == "" {
+			return fmt.Errorf("proxies[%d]: name is required", i)
+		}
+		if proxies[p.Name] {
+			return fmt.Errorf("proxies[%d]: duplicate name %q", i, p.Name)
+		}
+		proxies[p.Name] = true
+		if err := validateProxy(p); err != nil {
+			return fmt.Errorf("proxies[%d]: %w", i, err)
+		}
+	}
+	pools := make(map[string]bool)
+	for i, pl := range cfg.Pools {
+		if pl.Name == "" {
+			return fmt.Errorf("pools[%d]: name is required", i)
+		}
+		if pools[pl.Name] {
+			return fmt.Errorf("pools[%d]: duplicate name %q", i, pl.Name)
+		}
+		pools[pl.Name] = true
+		if len(pl.Proxies) == 0 {
+			return fmt.Errorf("pools[%d]: proxies is required", i)
+		}
+		for _, name := range pl.Proxies {
+			if !proxies[name] {
+				return fmt.Errorf("pools[%d]: unknown proxy %q", i, name)
+			}
+		}
+	}
+	return nil
+}
+
+func (cfg *Config) hasPool(name string) bool {
+	for _, pl := range cfg.Pools {
+		if pl.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// poolProxies returns the proxies of pool name.
+func (cfg *Config) poolProxies(name string) []*Proxy {
+	for _, pl := range cfg.Pools {
+		if pl.Name != name {
+			continue
+		}
+		var res []*Proxy
+		for _, pn := range pl.Proxies {
+			for _, p := range cfg.Proxies {
+				if p.Name == pn {
+					res = append(res, p)
+				}
+			}
+		}
+		return res
+	}
+	return nil
+}
+
+// proxyKey identifies an upstream connection. Proxy definitions with equal
+// keys share one *Proxy and thus one health state.
+type proxyKey struct {
+	typ, host, username, password string
+	port                          int
+	tls                           ProxyTLS
+}
+
+func keyOf(p *Proxy) proxyKey {
+	k := proxyKey{
+		typ:      strings.ToLower(p.Type),
+		host:     strings.ToLower(p.Host),
+		username: p.Username,
+		password: p.Password,
+		port:     p.Port,
+	}
+	if k.typ == "" {
+		k.typ = "socks5"
+	}
+	if p.TLS != nil && p.TLS.Enabled {
+		k.tls = *p.TLS
+	}
+	return k
+}
+
+// hopMember holds how a hop selects one of its proxies. Hops listing the
+// same upstream share its *Proxy but each keeps the priority, weight and
+// tags it was given there.
+type hopMember struct {
+	priority, weight int
+	group, country   string
+}
+
+func memberOf(p *Proxy) hopMember {
+	return hopMember{priority: p.Priority, weight: p.Weight, group: p.Group, country: p.Country}
+}
+
+// member returns the selection settings of p in h.
+func (h *Hop) member(p *Proxy) hopMember {
+	if m, ok := h.members[p]; ok {
+		return m
+	}
+	return memberOf(p)
+}
+
+// proxyRegistry dedupes proxy definitions across pools, hops and users.
+type proxyRegistry map[proxyKey]*Proxy
+
+// canonical returns the registered proxy equal to p, registering p if
+// there is none.
+func (r proxyRegistry) canonical(p *Proxy) *Proxy {
+	k := keyOf(p)
+	if c, ok := r[k]; ok {
+		return c
+	}
+	r[k] = p
+	return p
+}
+
+// uniqueProxies returns every distinct proxy of cfg, top-level ones first.
+func (cfg *Config) uniqueProxies() []*Proxy {
+	seen := make(map[*Proxy]bool)
+	var res []*Proxy
+	add := func(ps []*Proxy) {
+		for _, p := range ps {
+			if !seen[p] {
+				seen[p] = true
+				res = append(res, p)
+			}
+		}
+	}
+	add(cfg.Proxies)
+	for _, h := range cfg.hops() {
+		add(h.Proxies)
+	}
+	return res
+}
+
+// hops returns the hops of every user chain and named chain.
+func (cfg *Config) hops() []*Hop {
+	var hops []*Hop
+	for i := range cfg.Chains {
+		hops = append(hops, cfg.Chains[i].Chain...)
+	}
+	for i := range cfg.NamedChains {
+		hops = append(hops, cfg.NamedChains[i].Chain...)
+	}
+	return hops
+}
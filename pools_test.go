@@ -0,0 +1,96 @@
+package main
+
+import "testing"
+
+func TestPoolsShareProxies(t *testing.T) {
+	cfg, err := loadConfig("testdata/pools_config.yaml")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if err := initProxies(&cfg); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	alice, bob, carol := cfg.Chains[0].Chain[0], cfg.Chains[1].Chain[0], cfg.Chains[2].Chain[0]
+	if len(alice.Proxies) != 2 || alice.Proxies[0] != bob.Proxies[0] || alice.Proxies[1] != bob.Proxies[1] {
+		t.Fatal("hops using the same pool should share its proxies")
+	}
+	if carol.Proxies[0] != cfg.Proxies[0] {
+		t.Fatal("an identical inline definition should share the pool proxy")
+	}
+	if n := len(cfg.uniqueProxies()); n != 2 {
+		t.Fatalf("expected 2 distinct upstreams, got %d", n)
+	}
+}
+
+func TestSharedProxyPerHopWeights(t *testing.T) {
+	a := func(w int) *Proxy { return &Proxy{Name: "a", Host: "10.0.0.1", Port: 1080, Weight: w} }
+	b := func(w int) *Proxy { return &Proxy{Name: "b", Host: "10.0.0.2", Port: 1080, Weight: w} }
+	cfg := Config{Chains: []UserChain{{Username: "u", Chain: []*Hop{
+		{Strategy: "weighted", Proxies: []*Proxy{a(5), b(1)}},
+		{Strategy: "weighted", Proxies: []*Proxy{a(1), b(5)}},
+	}}}}
+	if err := initProxies(&cfg); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	first, second := cfg.Chains[0].Chain[0], cfg.Chains[0].Chain[1]
+	if first.Proxies[0] != second.Proxies[0] || first.Proxies[1] != second.Proxies[1] {
+		t.Fatal("hops listing the same upstream should share its proxy")
+	}
+	pa := first.Proxies[0]
+	if first.weight(pa) != 5 || second.weight(pa) != 1 {
+		t.Fatalf("weights %d and %d, want 5 and 1", first.weight(pa), second.weight(pa))
+	}
+	leads := [2]int{}
+	for i := 0; i < 6; i++ {
+		if first.orderedProxies(dialInfo{})[0] == pa {
+			leads[0]++
+		}
+		if second.orderedProxies(dialInfo{})[0] == pa {
+			leads[1]++
+		}
+	}
+	if leads != [2]int{5, 1} {
+		t.Fatalf("a led %v times, want [5 1]", leads)
+	}
+}
+
+func TestValidatePools(t *testing.T) {
+	de := &Proxy{Name: "de", Host: "10.0.0.1", Port: 1080}
+	for _, cfg := range []Config{
+		{Proxies: []*Proxy{{Host: "10.0.0.1", Port: 1080}}},
+		{Proxies: []*Proxy{de, de}},
+		{Proxies: []*Proxy{{Name: "x", Port: 1080}}},
+		{Proxies: []*Proxy{de}, Pools: []Pool{{Name: "eu"}}},
+		{Proxies: []*Proxy{de}, Pools: []Pool{{Name: "eu", Proxies: []string{"fr"}}}},
+		{Proxies: []*Proxy{de}, Pools: []Pool{{Name: "eu", Proxies: []string{"de"}}, {Name: "eu", Proxies: []string{"de"}}}},
+	} {
+		if err := validatePools(&cfg); err == nil {
+			t.Fatalf("expected error for %+v", cfg)
+		}
+	}
+}
+
+func TestValidateHopPool(t *testing.T) {
+	base := func(h *Hop) Config {
+		return Config{
+			General: General{Bind: "127.0.0.1", Port: 1080, HealthCheckInterval: 1, HealthCheckTimeout: 1, HealthCheckConcurrent: 1, IOTimeout: 1, IdleTimeout: 1, MaxConnections: 1},
+			Proxies: []*Proxy{{Name: "de", Host: "10.0.0.1", Port: 1080}},
+			Pools:   []Pool{{Name: "eu", Proxies: []string{"de"}}},
+			Chains:  []UserChain{{Username: "u", Chain: []*Hop{h}}},
+		}
+	}
+	for _, h := range []*Hop{
+		{Pool: "us"},
+		{Pool: "eu", Host: "10.0.0.2", Port: 1080},
+		{Pool: "eu", Strategy: "fastest"},
+	} {
+		cfg := base(h)
+		if err := validateConfig(&cfg); err == nil {
+			t.Fatalf("expected error for %+v", h)
+		}
+	}
+	cfg := base(&Hop{Pool: "eu", Strategy: "rr"})
+	if err := validateConfig(&cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
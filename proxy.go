@@ -11,6 +11,14 @@ import (
 // proxy copies data between a and b. When one side returns an error or EOF,
 // the opposite connection is closed to ensure both sides terminate.
 func proxy(a, b net.Conn) {
+	for _, c := range []net.Conn{a, b} {
+		if cc, ok := c.(*chainConn); ok {
+			for _, p := range cc.combo {
+				p.active.Add(1)
+				defer p.active.Add(-1)
+			}
+		}
+	}
 	var wg sync.WaitGroup
 	wg.Add(2)
 
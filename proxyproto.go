@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// proxyV1Prefix and proxyV2Sig start every PROXY protocol v1 and v2
+// header.
+var (
+	proxyV1Prefix = []byte("PROXY ")
+	proxyV2Sig    = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+func validateProxyProtocol(p *ProxyProtocol) error {
+	if p == nil || !p.Enabled {
+		return nil
+	}
+	if len(p.Trusted) == 0 {
+		return fmt.Errorf("proxy_protocol.trusted is required")
+	}
+	if _, err := parseCIDRs(p.Trusted); err != nil {
+		return fmt.Errorf("proxy_protocol.trusted: %w", err)
+	}
+	return nil
+}
+
+// parseCIDRs parses a list of CIDR networks; bare IP addresses match only
+// themselves.
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtoListener expects a PROXY protocol header on connections from
+// trusted sources. Connections from other sources are passed through
+// unchanged. Unix socket peers are always trusted.
+type proxyProtoListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if ra, ok := c.RemoteAddr().(*net.TCPAddr); ok && !ipInNets(ra.IP, l.trusted) {
+		return c, nil
+	}
+	return &proxiedConn{Conn: c}, nil
+}
+
+// proxiedConn reads the PROXY protocol header on first use and reports the
+// client address it carries as the remote address. Callers must set a
+// deadline before the first Read or RemoteAddr.
+type proxiedConn struct {
+	net.Conn
+	once sync.Once
+	r    *bufio.Reader
+	src  net.Addr
+	err  error
+}
+
+func (c *proxiedConn) init() {
+	c.once.Do(func() {
+		c.r = bufio.NewReader(c.Conn)
+		c.src, c.err = readProxyHeader(c.r)
+		if c.err != nil {
+			warnLog.Printf("proxy protocol from %s: %v", c.Conn.RemoteAddr(), c.err)
+		}
+	})
+}
+
+func (c *proxiedConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader consumes a PROXY protocol v1 or v2 header from r and
+// returns the source address it announces, or nil for LOCAL and UNKNOWN
+// headers that carry no client address.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	// The shortest v1 header, "PROXY UNKNOWN\r\n", is shorter than the v2
+	// signature, so only wait for the full signature when it is not v1.
+	prefix, err := r.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(prefix, proxyV1Prefix) {
+		return readProxyV1(r)
+	}
+	if !bytes.HasPrefix(proxyV2Sig, prefix) {
+		return nil, fmt.Errorf("missing header")
+	}
+	sig, err := r.Peek(len(proxyV2Sig))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(sig, proxyV2Sig) {
+		return nil, fmt.Errorf("missing header")
+	}
+	return readProxyV2(r)
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// A v1 header is at most 107 bytes including the CRLF.
+	line := make([]byte, 0, 107)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) == cap(line) {
+			return nil, fmt.Errorf("v1 header too long")
+		}
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, fmt.Errorf("v1 header not terminated by CRLF")
+	}
+	fields := strings.Split(s, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("bad v1 header %q", s)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("bad v1 source %s:%s", fields[2], fields[4])
+	}
+	if (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("v1 source %s does not match %s", fields[2], fields[1])
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	switch hdr[12] & 0x0F {
+	case 0x00: // LOCAL, e.g. health checks from the balancer
+		return nil, nil
+	case 0x01: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %d", hdr[12]&0x0F)
+	}
+	if hdr[13]>>4 == 0x0 { // AF_UNSPEC
+		return nil, nil
+	}
+	if transport := hdr[13] & 0x0F; transport != 0x1 {
+		return nil, fmt.Errorf("unsupported v2 transport %d", transport)
+	}
+	switch hdr[13] >> 4 {
+	case 0x1: // AF_INET
+		if len(body) < 12 {
+			return nil, fmt.Errorf("short v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x2: // AF_INET6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("short v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	return nil, nil
+}
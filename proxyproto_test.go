@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func proxyV2Header(cmd, fam byte, addrs []byte) []byte {
+	hdr := append([]byte{}, proxyV2Sig...)
+	hdr = append(hdr, 0x20|cmd, fam, byte(len(addrs)>>8), byte(len(addrs)))
+	return append(hdr, addrs...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 10, 0, 0, 1, 0x30, 0x39, 0x04, 0x38}
+	v6 := make([]byte, 36)
+	copy(v6, net.ParseIP("2001:db8::1"))
+	v6[32], v6[33] = 0x00, 0x50
+	tests := []struct {
+		name    string
+		in      []byte
+		want    string
+		wantErr bool
+	}{
+		{name: "v1 tcp4", in: []byte("PROXY TCP4 192.0.2.1 10.0.0.1 12345 1080\r\n"), want: "192.0.2.1:12345"},
+		{name: "v1 tcp6", in: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 80 1080\r\n"), want: "[2001:db8::1]:80"},
+		{name: "v1 unknown", in: []byte("PROXY UNKNOWN\r\n")},
+		{name: "v1 family mismatch", in: []byte("PROXY TCP4 2001:db8::1 10.0.0.1 1 2\r\n"), wantErr: true},
+		{name: "v1 no crlf", in: []byte("PROXY TCP4 192.0.2.1 10.0.0.1 1 2\n"), wantErr: true},
+		{name: "v1 too long", in: []byte("PROXY " + strings.Repeat("x", 120) + "\r\n"), wantErr: true},
+		{name: "v2 ipv4", in: proxyV2Header(0x01, 0x11, v4), want: "192.0.2.1:12345"},
+		{name: "v2 ipv6 with tlv", in: proxyV2Header(0x01, 0x21, append(v6, 0x04, 0x00, 0x01, 'x')), want: "[2001:db8::1]:80"},
+		{name: "v2 local", in: proxyV2Header(0x00, 0x00, nil)},
+		{name: "v2 short", in: proxyV2Header(0x01, 0x11, v4[:4]), wantErr: true},
+		{name: "v2 udp", in: proxyV2Header(0x01, 0x12, v4), wantErr: true},
+		{name: "v2 unspec", in: proxyV2Header(0x01, 0x00, nil)},
+		{name: "v2 bad signature", in: append([]byte("\r\n\r\n\x00\r\nQUIT!"), 0x21, 0x11, 0, 0), wantErr: true},
+		{name: "missing", in: []byte{0x05, 0x01, 0x00, 0, 0, 0, 0, 0, 0, 0, 0, 0}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(append(tt.in, "rest"...)))
+			addr, err := readProxyHeader(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+			rest, _ := io.ReadAll(r)
+			if string(rest) != "rest" {
+				t.Fatalf("header consumed too much: %q", rest)
+			}
+		})
+	}
+}
+
+// A client that waits for the server to speak first sends nothing after a
+// minimal v1 header, so the header must be read without blocking for more.
+func TestReadProxyHeaderShortV1(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go client.Write([]byte("PROXY UNKNOWN\r\n"))
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	addr, err := readProxyHeader(bufio.NewReader(server))
+	if err != nil || addr != nil {
+		t.Fatalf("got %v, %v; want nil, nil", addr, err)
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	origWarn := warnLog
+	warnLog = nopLogger{}
+	defer func() { warnLog = origWarn }()
+
+	for _, tt := range []struct {
+		trusted string
+		want    string
+		data    string
+	}{
+		{trusted: "127.0.0.0/8", want: "192.0.2.1", data: "ping"},
+		{trusted: "10.0.0.1", want: "127.0.0.1", data: "PROXY TCP4 192.0.2.1 10.0.0.1 12345 1080\r\nping"},
+	} {
+		t.Run(tt.trusted, func(t *testing.T) {
+			l := &Listener{Address: "127.0.0.1:0", ProxyProtocol: &ProxyProtocol{Enabled: true, Trusted: []string{tt.trusted}}}
+			if err := validateProxyProtocol(l.ProxyProtocol); err != nil {
+				t.Fatalf("validate: %v", err)
+			}
+			ln, err := l.listen()
+			if err != nil {
+				t.Fatalf("listen: %v", err)
+			}
+			defer ln.Close()
+			client, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer client.Close()
+			if _, err := client.Write([]byte("PROXY TCP4 192.0.2.1 10.0.0.1 12345 1080\r\nping")); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			c, err := ln.Accept()
+			if err != nil {
+				t.Fatalf("accept: %v", err)
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(time.Second))
+			if ra := c.RemoteAddr().(*net.TCPAddr); ra.IP.String() != tt.want {
+				t.Fatalf("remote address %s, want %s", ra.IP, tt.want)
+			}
+			buf := make([]byte, len(tt.data))
+			if _, err := io.ReadFull(c, buf); err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if string(buf) != tt.data {
+				t.Fatalf("unexpected data %q", buf)
+			}
+		})
+	}
+}
+
+func TestValidateProxyProtocol(t *testing.T) {
+	if err := validateProxyProtocol(&ProxyProtocol{Enabled: true}); err == nil {
+		t.Fatal("expected error without trusted sources")
+	}
+	if err := validateProxyProtocol(&ProxyProtocol{Enabled: true, Trusted: []string{"10.0.0.0/33"}}); err == nil {
+		t.Fatal("expected error for bad CIDR")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+const defaultRaceConcurrency = 2
+
+// raceDelay is the stagger before another candidate combo is started while
+// earlier ones are still connecting. Zero tries combos one at a time.
+var raceDelay time.Duration
+
+var raceConcurrency = defaultRaceConcurrency
+
+// errRaceLost cancels attempts that lost a race, so that their proxies are
+// not blamed for the cancellation.
+var errRaceLost = errors.New("another chain connected first")
+
+// comboIterator returns a function yielding the combos of chain in the
+// order the hops rank their proxies, and nil once all were produced.
+func comboIterator(chain []*Hop, info dialInfo) func() []*Proxy {
+	ordered := make([][]*Proxy, len(chain))
+	for i, h := range chain {
+		ordered[i] = h.orderedProxies(info)
+		if len(ordered[i]) == 0 {
+			return func() []*Proxy { return nil }
+		}
+	}
+	idx := make([]int, len(chain))
+	done := false
+	return func() []*Proxy {
+		if done {
+			return nil
+		}
+		combo := make([]*Proxy, len(chain))
+		for i := range chain {
+			combo[i] = ordered[i][idx[i]]
+		}
+		// Advance the last hop fastest, like dialChainRecursive does.
+		done = true
+		for i := len(idx) - 1; i >= 0; i-- {
+			idx[i]++
+			if idx[i] < len(ordered[i]) {
+				done = false
+				break
+			}
+			idx[i] = 0
+		}
+		return combo
+	}
+}
+
+type raceResult struct {
+	conn  net.Conn
+	bnd   boundAddr
+	combo []*Proxy
+	err   error
+}
+
+// raceChain connects through the combos of chain like dialChainRecursive,
+// but starts the next combo after raceDelay, or as soon as an attempt
+// fails, with at most raceConcurrency attempts in flight. The first combo
+// to complete the whole chain wins and is copied into current; the others
+// are cancelled and their connections closed.
+func raceChain(ctx context.Context, chain []*Hop, current []*Proxy, info dialInfo, att *chainAttempts, cmd byte, finalHost string, finalPort int) (net.Conn, boundAddr, error) {
+	if len(chain) == 0 {
+		return requestThrough(ctx, current, cmd, finalHost, finalPort)
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	next := comboIterator(chain, info)
+	results := make(chan raceResult)
+	running := 0
+	start := func() bool {
+		if att.exhausted() || ctx.Err() != nil {
+			return false
+		}
+		combo := next()
+		for combo != nil && att.blocked(combo) {
+			combo = next()
+		}
+		if combo == nil {
+			return false
+		}
+		att.started++
+		running++
+		go func() {
+			conn, bnd, err := requestThrough(ctx, combo, cmd, finalHost, finalPort)
+			results <- raceResult{conn: conn, bnd: bnd, combo: combo, err: err}
+		}()
+		return true
+	}
+	if !start() {
+		cancel(nil)
+		return nil, boundAddr{}, att.err()
+	}
+	stagger := time.NewTimer(raceDelay)
+	defer stagger.Stop()
+	for running > 0 {
+		select {
+		case r := <-results:
+			running--
+			if r.err == nil {
+				cancel(errRaceLost)
+				go drainRace(results, running)
+				copy(current, r.combo)
+				return r.conn, r.bnd, nil
+			}
+			att.record(r.combo, r.err)
+			if start() {
+				stagger.Reset(raceDelay)
+			}
+		case <-stagger.C:
+			if running < raceConcurrency && start() {
+				debugLog.Printf("chain attempt still pending after %s, racing another", raceDelay)
+				stagger.Reset(raceDelay)
+			}
+		}
+	}
+	cancel(nil)
+	return nil, boundAddr{}, att.err()
+}
+
+// drainRace collects the n attempts still running after a race was won and
+// closes any connection they complete.
+func drainRace(results <-chan raceResult, n int) {
+	for ; n > 0; n-- {
+		if r := <-results; r.conn != nil {
+			r.conn.Close()
+		}
+	}
+}
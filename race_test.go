@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestComboIterator(t *testing.T) {
+	a := &Proxy{Name: "a", Host: "h1", Port: 1}
+	b := &Proxy{Name: "b", Host: "h2", Port: 2}
+	c := &Proxy{Name: "c", Host: "h3", Port: 3}
+	d := &Proxy{Name: "d", Host: "h4", Port: 4}
+	cfg := Config{Chains: []UserChain{{Chain: []*Hop{{Proxies: []*Proxy{a, b}}, {Proxies: []*Proxy{c, d}}}}}}
+	initProxies(&cfg)
+	next := comboIterator(cfg.Chains[0].Chain, dialInfo{})
+	var got []string
+	for combo := next(); combo != nil; combo = next() {
+		got = append(got, combo[0].Name+combo[1].Name)
+	}
+	want := []string{"ac", "ad", "bc", "bd"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestRaceChainSkipsStalledProxy(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	origDelay, origTimeout := raceDelay, ioTimeout
+	raceDelay, ioTimeout = 20*time.Millisecond, 300*time.Millisecond
+	defer func() {
+		warnLog, debugLog = origWarn, origDebug
+		raceDelay, ioTimeout = origDelay, origTimeout
+	}()
+
+	// stalled accepts connections but never answers the SOCKS handshake.
+	stalled, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer stalled.Close()
+	go func() {
+		for {
+			c, err := stalled.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	target := startPongServer(t)
+	defer target.Close()
+	hop := startTestServer(t, &Listener{}, nil)
+	defer hop.Close()
+
+	slow := &Proxy{Name: "slow", Host: "127.0.0.1", Port: stalled.Addr().(*net.TCPAddr).Port}
+	fast := &Proxy{Name: "fast", Host: "127.0.0.1", Port: hop.Addr().(*net.TCPAddr).Port}
+	cfg := Config{Chains: []UserChain{{Username: "u", Chain: []*Hop{{Proxies: []*Proxy{slow, fast}}}}}}
+	initProxies(&cfg)
+	state := &ChainState{name: "u", chain: cfg.Chains[0].Chain}
+
+	start := time.Now()
+	conn, err := dialChain(t.Context(), state, "127.0.0.1", target.Addr().(*net.TCPAddr).Port)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if elapsed := time.Since(start); elapsed >= ioTimeout {
+		t.Fatalf("race took %s, expected the second combo to win", elapsed)
+	}
+	if got := conn.(*chainConn).combo[0]; got != fast {
+		t.Fatalf("expected fast to win, got %s", got.Name)
+	}
+	pingPong(t, conn)
+
+	// The cancelled attempt must not mark the stalled proxy dead.
+	time.Sleep(2 * ioTimeout)
+	if !slow.alive.Load() {
+		t.Fatal("losing proxy was marked dead")
+	}
+}
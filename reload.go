@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"reflect"
 	"sync"
 	"sync/atomic"
@@ -27,45 +28,92 @@ func startConfigReload(ctx context.Context, cfg *Config) {
 				return
 			case <-ticker.C:
 			}
-			newCfg, err := loadConfig(*configPath)
-			if err != nil {
+			if err := reloadConfig(ctx, cfg); err != nil {
 				warnLog.Printf("config reload failed: %v", err)
-				continue
 			}
-			initProxies(&newCfg)
-			newChains, err := buildUserChains(newCfg.Chains)
-			if err != nil {
-				warnLog.Printf("config reload build chains: %v", err)
-				continue
-			}
-			chainsMu.Lock()
-			oldChains := userChains.Load().(map[string]*ChainState)
-			updated := make(map[string]*ChainState, len(newChains))
-			for name, st := range newChains {
-				if old, ok := oldChains[name]; ok {
-					if reflect.DeepEqual(old.chain, st.chain) && old.password == st.password {
-						updated[name] = old
-					} else {
-						updated[name] = st
-						cleanupChain(ctx, old)
-					}
-				} else {
-					updated[name] = st
-				}
-			}
-			for name, old := range oldChains {
-				if _, ok := updated[name]; !ok {
-					cleanupChain(ctx, old)
-				}
-			}
-			cfg.Chains = newCfg.Chains
-			userChains.Store(updated)
-			chainsMu.Unlock()
-			infoLog.Printf("reloaded %d chains", len(updated))
 		}
 	}()
 }
 
+// reloadConfig rereads the config file and swaps in its proxies, chains
+// and rules. Chains that did not change keep their state.
+func reloadConfig(ctx context.Context, cfg *Config) error {
+	newCfg, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if err := reinitProxies(&newCfg, cfg); err != nil {
+		return fmt.Errorf("init proxies: %w", err)
+	}
+	newChains, err := buildUserChains(newCfg.Chains)
+	if err != nil {
+		return fmt.Errorf("build chains: %w", err)
+	}
+	// The new rules may need databases the old ones did not.
+	if err := initGeoIP(newCfg.General); err != nil {
+		return err
+	}
+	rulesResolve.Store(newCfg.General.RulesResolve)
+	chainsMu.Lock()
+	oldChains := userChains.Load().(map[string]*ChainState)
+	updated := make(map[string]*ChainState, len(newChains))
+	for name, st := range newChains {
+		if old, ok := oldChains[name]; ok {
+			if sameChain(old.chain, st.chain) && old.password == st.password {
+				updated[name] = old
+			} else {
+				updated[name] = st
+				cleanupChain(ctx, old)
+			}
+		} else {
+			updated[name] = st
+		}
+	}
+	for name, old := range oldChains {
+		if _, ok := updated[name]; !ok {
+			cleanupChain(ctx, old)
+		}
+	}
+	// Health checks walk cfg, so they pick up the new upstreams.
+	cfg.Proxies, cfg.Pools = newCfg.Proxies, newCfg.Pools
+	cfg.Chains, cfg.NamedChains, cfg.Rules = newCfg.Chains, newCfg.NamedChains, newCfg.Rules
+	userChains.Store(updated)
+	installRouting(ctx, &newCfg)
+	chainsMu.Unlock()
+	infoLog.Printf("reloaded %d chains", len(updated))
+	return nil
+}
+
+// sameChain reports whether a and b are configured alike. Only settings
+// from the config file are compared, not selection or health state.
+func sameChain(a, b []*Hop) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].sameAs(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *Hop) sameAs(o *Hop) bool {
+	if h.Strategy != o.Strategy || h.HashKey != o.HashKey || h.Pool != o.Pool ||
+		h.Name != o.Name || h.Type != o.Type || h.Username != o.Username ||
+		h.Password != o.Password || h.Host != o.Host || h.Port != o.Port ||
+		!reflect.DeepEqual(h.TLS, o.TLS) || len(h.Proxies) != len(o.Proxies) {
+		return false
+	}
+	for i, p := range h.Proxies {
+		q := o.Proxies[i]
+		if p.Name != q.Name || keyOf(p) != keyOf(q) || h.member(p) != o.member(q) {
+			return false
+		}
+	}
+	return true
+}
+
 func cleanupChain(ctx context.Context, cs *ChainState) {
 	go func() {
 		timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
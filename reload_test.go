@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReloadConfigKeepsProxyState(t *testing.T) {
+	origInfo, origWarn := infoLog, warnLog
+	infoLog, warnLog = nopLogger{}, nopLogger{}
+	origPath := *configPath
+	defer func() {
+		infoLog, warnLog = origInfo, origWarn
+		*configPath = origPath
+		userChains.Store(map[string]*ChainState(nil))
+		routes.Store(nil)
+	}()
+
+	cfg, err := loadConfig("testdata/pools_config.yaml")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if err := initProxies(&cfg); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	chains, err := buildUserChains(cfg.Chains)
+	if err != nil {
+		t.Fatalf("build chains: %v", err)
+	}
+	userChains.Store(chains)
+	installRouting(t.Context(), &cfg)
+	de := cfg.Proxies[0]
+	de.alive.Store(false)
+
+	// fr-1 is replaced by es-1 and carol moves to a new named chain.
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err = os.WriteFile(path, []byte(`
+general:
+  bind: 127.0.0.1
+  port: 1080
+proxies:
+  - name: de-1
+    host: 10.0.0.1
+    port: 1080
+  - name: es-1
+    host: 10.0.0.3
+    port: 1080
+pools:
+  - name: eu
+    proxies: [de-1, es-1]
+chains:
+  - username: alice
+    password: pass
+    chain:
+      - pool: eu
+        strategy: latency
+  - username: bob
+    password: pass
+    chain:
+      - name: de-copy
+        host: 10.0.0.1
+        port: 1080
+named_chains:
+  - name: es
+    chain:
+      - host: 10.0.0.3
+        port: 1080
+`), 0o600)
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	*configPath = path
+	if err := reloadConfig(t.Context(), &cfg); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+
+	proxies := cfg.uniqueProxies()
+	if len(proxies) != 2 || proxies[0] != de {
+		t.Fatalf("expected de-1 to be kept and one new upstream, got %d proxies", len(proxies))
+	}
+	if de.alive.Load() {
+		t.Fatal("reload revived a dead upstream")
+	}
+	es := proxies[1]
+	if es.Host != "10.0.0.3" || !es.alive.Load() {
+		t.Fatalf("unexpected new upstream %s:%d alive=%v", es.Host, es.Port, es.alive.Load())
+	}
+	if routes.Load().chains["es"].chain[0].Proxies[0] != es {
+		t.Fatal("named chain should use the shared upstream")
+	}
+	updated := userChains.Load().(map[string]*ChainState)
+	if updated["alice"] == chains["alice"] {
+		t.Fatal("alice's pool changed, her chain should be rebuilt")
+	}
+	if _, ok := updated["carol"]; ok {
+		t.Fatal("removed user carol is still configured")
+	}
+}
+
+func TestReloadConfigGeoIP(t *testing.T) {
+	origInfo, origWarn := infoLog, warnLog
+	infoLog, warnLog = nopLogger{}, nopLogger{}
+	origPath, origResolve := *configPath, rulesResolve.Load()
+	defer func() {
+		infoLog, warnLog = origInfo, origWarn
+		*configPath = origPath
+		rulesResolve.Store(origResolve)
+		userChains.Store(map[string]*ChainState(nil))
+		routes.Store(nil)
+		countryDB.Store(nil)
+		asnDB.Store(nil)
+	}()
+
+	cfg := Config{}
+	userChains.Store(map[string]*ChainState{})
+	installRouting(t.Context(), &cfg)
+
+	dir := t.TempDir()
+	write := func(db string) {
+		t.Helper()
+		*configPath = filepath.Join(dir, "config.yaml")
+		err := os.WriteFile(*configPath, []byte(`
+general:
+  bind: 127.0.0.1
+  port: 1080
+  geoip_database: `+db+`
+  rules_resolve: true
+rules:
+  - geoip: [CN]
+    action: reject
+`), 0o600)
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	write(filepath.Join(dir, "missing.mmdb"))
+	if err := reloadConfig(t.Context(), &cfg); err == nil || !strings.HasPrefix(err.Error(), "general.geoip_database: ") {
+		t.Fatalf("expected geoip_database error, got %v", err)
+	}
+	if len(routes.Load().rules) != 0 || rulesResolve.Load() {
+		t.Fatal("a failed reload must not install the new rules")
+	}
+
+	write(writeMMDB(t, testGeoNetworks))
+	if err := reloadConfig(t.Context(), &cfg); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if !rulesResolve.Load() {
+		t.Fatal("rules_resolve was not applied")
+	}
+	if got := lookupCountry(net.ParseIP("1.0.1.1")); got != "CN" {
+		t.Fatalf("country %q after reload, want CN", got)
+	}
+	if len(routes.Load().rules) != 1 {
+		t.Fatal("new rules were not installed")
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultRejectReply is the SOCKS5 "connection not allowed by ruleset"
+// reply.
+const defaultRejectReply = 0x02
+
+// NamedChain is a chain that routing rules can send connections through
+// with action chain:<name>, whatever user made them.
+type NamedChain struct {
+	Name  string `yaml:"name"`
+	Chain []*Hop `yaml:"chain"`
+}
+
+// Rule routes the connections it matches. Destination conditions
+// (domain, domain_suffix, domain_regex, cidr, geoip, asn) match if any of
+// them does; every other condition that is set must match as well.
+type Rule struct {
+	Domain       []string `yaml:"domain"`
+	DomainSuffix []string `yaml:"domain_suffix"`
+	DomainRegex  []string `yaml:"domain_regex"`
+	CIDR         []string `yaml:"cidr"`
+	GeoIP        []string `yaml:"geoip"`
+	ASN          []uint32 `yaml:"asn"`
+	Ports        []string `yaml:"ports"`
+	Users        []string `yaml:"users"`
+	ClientCIDR   []string `yaml:"client_cidr"`
+	ClientGeoIP  []string `yaml:"client_geoip"`
+	ClientASN    []uint32 `yaml:"client_asn"`
+	// Action is direct, chain:<name>, reject or blackhole.
+	Action string `yaml:"action"`
+	// Reply is the SOCKS5 reply code sent by reject.
+	Reply int `yaml:"reply"`
+
+	index      int              `yaml:"-"`
+	chain      string           `yaml:"-"`
+	regexps    []*regexp.Regexp `yaml:"-"`
+	nets       []*net.IPNet     `yaml:"-"`
+	clientNets []*net.IPNet     `yaml:"-"`
+	ports      [][2]int         `yaml:"-"`
+}
+
+// compile checks r and prepares its conditions for matching.
+func (r *Rule) compile() error {
+	action, name, _ := strings.Cut(r.Action, ":")
+	switch action {
+	case "direct", "reject", "blackhole":
+		if name != "" {
+			return fmt.Errorf("invalid action %q", r.Action)
+		}
+	case "chain":
+		if name == "" {
+			return fmt.Errorf("action chain requires a name, as in chain:<name>")
+		}
+		r.chain = name
+	default:
+		return fmt.Errorf("action must be direct, chain:<name>, reject or blackhole")
+	}
+	if r.Reply != 0 && action != "reject" {
+		return fmt.Errorf("reply requires action reject")
+	}
+	if r.Reply < 0 || r.Reply > 0x08 {
+		return fmt.Errorf("reply must be a SOCKS5 error code between 0x01 and 0x08")
+	}
+	r.regexps = nil
+	for _, expr := range r.DomainRegex {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("domain_regex: %w", err)
+		}
+		r.regexps = append(r.regexps, re)
+	}
+	var err error
+	if r.nets, err = parseCIDRs(r.CIDR); err != nil {
+		return fmt.Errorf("cidr: %w", err)
+	}
+	if r.clientNets, err = parseCIDRs(r.ClientCIDR); err != nil {
+		return fmt.Errorf("client_cidr: %w", err)
+	}
+	for _, code := range slices.Concat(r.GeoIP, r.ClientGeoIP) {
+		if len(code) != 2 {
+			return fmt.Errorf("invalid country code %q", code)
+		}
+	}
+	r.ports = nil
+	for _, pr := range r.Ports {
+		lo, hi, err := parsePortRange(pr)
+		if err != nil {
+			return fmt.Errorf("ports: %w", err)
+		}
+		r.ports = append(r.ports, [2]int{lo, hi})
+	}
+	return nil
+}
+
+// parsePortRange parses "443" or "8000-8999".
+func parsePortRange(s string) (int, int, error) {
+	loStr, hiStr, isRange := strings.Cut(s, "-")
+	lo, err := strconv.Atoi(strings.TrimSpace(loStr))
+	hi := lo
+	if err == nil && isRange {
+		hi, err = strconv.Atoi(strings.TrimSpace(hiStr))
+	}
+	if err != nil || lo < 1 || hi > 65535 || lo > hi {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return lo, hi, nil
+}
+
+func validateRules(cfg *Config) error {
+	names := make(map[string]bool)
+	for i, nc := range cfg.NamedChains {
+		if nc.Name == "" {
+			return fmt.Errorf("named_chains[%d]: name is required", i)
+		}
+		if names[nc.Name] {
+			return fmt.Errorf("named_chains[%d]: duplicate name %q", i, nc.Name)
+		}
+		names[nc.Name] = true
+		if len(nc.Chain) == 0 {
+			return fmt.Errorf("named_chains[%d]: chain is required", i)
+		}
+		for hi, hop := range nc.Chain {
+			if err := validateHop(cfg, hop, fmt.Sprintf("named_chains[%d].chain[%d]", i, hi)); err != nil {
+				return err
+			}
+		}
+	}
+	for i, r := range cfg.Rules {
+		if err := r.compile(); err != nil {
+			return fmt.Errorf("rules[%d]: %w", i, err)
+		}
+		r.index = i
+		if r.chain != "" && !names[r.chain] {
+			return fmt.Errorf("rules[%d]: unknown chain %q", i, r.chain)
+		}
+		if (len(r.GeoIP) > 0 || len(r.ClientGeoIP) > 0) && cfg.General.GeoIPDatabase == "" {
+			return fmt.Errorf("rules[%d]: geoip requires general.geoip_database", i)
+		}
+		if (len(r.ASN) > 0 || len(r.ClientASN) > 0) && cfg.General.ASNDatabase == "" {
+			return fmt.Errorf("rules[%d]: asn requires general.asn_database", i)
+		}
+		for _, u := range r.Users {
+			if !hasUser(cfg.Chains, u) {
+				return fmt.Errorf("rules[%d]: user %q is not configured", i, u)
+			}
+		}
+	}
+	return nil
+}
+
+// ruleRequest is the connection routing rules are matched against.
+type ruleRequest struct {
+	ctx    context.Context
+	user   string
+	client net.IP
+	host   string
+	port   int
+	// ip is the destination address, if known.
+	ip       net.IP
+	resolved bool
+}
+
+// destIP returns the destination address, resolving a domain destination
+// first when rulesResolve is set.
+func (q *ruleRequest) destIP() net.IP {
+	if q.ip != nil || q.resolved || !rulesResolve.Load() {
+		return q.ip
+	}
+	q.resolved = true
+	ips, err := resolveHost(q.ctx, q.host)
+	if err != nil || len(ips) == 0 {
+		debugLog.Printf("rules: resolve %s: %v", q.host, err)
+		return nil
+	}
+	q.ip = ips[0]
+	return q.ip
+}
+
+// matches reports whether r applies to q.
+func (r *Rule) matches(q *ruleRequest) bool {
+	if len(r.Users) > 0 && (q.user == "" || !containsString(r.Users, q.user)) {
+		return false
+	}
+	if len(r.clientNets) > 0 && (q.client == nil || !ipInNets(q.client, r.clientNets)) {
+		return false
+	}
+	if len(r.ClientGeoIP) > 0 && !containsFold(r.ClientGeoIP, lookupCountry(q.client)) {
+		return false
+	}
+	if len(r.ClientASN) > 0 && !slices.Contains(r.ClientASN, lookupASN(q.client)) {
+		return false
+	}
+	if len(r.ports) > 0 {
+		ok := false
+		for _, pr := range r.ports {
+			if q.port >= pr[0] && q.port <= pr[1] {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	byName := len(r.Domain) > 0 || len(r.DomainSuffix) > 0 || len(r.regexps) > 0
+	byIP := len(r.nets) > 0 || len(r.GeoIP) > 0 || len(r.ASN) > 0
+	if !byName && !byIP {
+		return true
+	}
+	if byName && net.ParseIP(q.host) == nil && r.matchesDomain(q.host) {
+		return true
+	}
+	if !byIP {
+		return false
+	}
+	ip := q.destIP()
+	if ip == nil {
+		return false
+	}
+	return ipInNets(ip, r.nets) ||
+		(len(r.GeoIP) > 0 && containsFold(r.GeoIP, lookupCountry(ip))) ||
+		(len(r.ASN) > 0 && slices.Contains(r.ASN, lookupASN(ip)))
+}
+
+func (r *Rule) matchesDomain(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, d := range r.Domain {
+		if strings.EqualFold(host, d) {
+			return true
+		}
+	}
+	for _, suffix := range r.DomainSuffix {
+		suffix = strings.ToLower(strings.TrimPrefix(suffix, "."))
+		if host == suffix || strings.HasSuffix(host, "."+suffix) {
+			return true
+		}
+	}
+	for _, re := range r.regexps {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsFold reports whether list holds s, ignoring case. An empty s is
+// never contained.
+func containsFold(list []string, s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) rejects() bool { return r != nil && r.Action == "reject" }
+
+func (r *Rule) blackholes() bool { return r != nil && r.Action == "blackhole" }
+
+// replyCode returns the SOCKS5 reply code for a rejecting rule.
+func (r *Rule) replyCode() byte {
+	if r.Reply == 0 {
+		return defaultRejectReply
+	}
+	return byte(r.Reply)
+}
+
+type routing struct {
+	rules  []*Rule
+	chains map[string]*ChainState
+}
+
+var routes atomic.Pointer[routing]
+
+// installRouting makes the rules and named chains of cfg current. Named
+// chains whose definition did not change keep their state and caches.
+func installRouting(ctx context.Context, cfg *Config) {
+	old := routes.Load()
+	rt := &routing{rules: cfg.Rules, chains: make(map[string]*ChainState, len(cfg.NamedChains))}
+	for _, nc := range cfg.NamedChains {
+		if old != nil {
+			if st, ok := old.chains[nc.Name]; ok && sameChain(st.chain, nc.Chain) {
+				rt.chains[nc.Name] = st
+				continue
+			}
+		}
+		rt.chains[nc.Name] = &ChainState{name: nc.Name, chain: nc.Chain}
+	}
+	routes.Store(rt)
+	if old == nil {
+		return
+	}
+	for name, st := range old.chains {
+		if rt.chains[name] != st {
+			cleanupChain(ctx, st)
+		}
+	}
+}
+
+// route applies the routing rules to a request for host:port by state's
+// user. It returns the chain to dial through, nil for a direct connection,
+// and the rule that matched, if any. Without a matching rule the user's
+// own chain is used.
+func route(ctx context.Context, state *ChainState, host string, port int) (*ChainState, *Rule) {
+	rt := routes.Load()
+	if rt == nil {
+		return state, nil
+	}
+	q := &ruleRequest{
+		ctx:    ctx,
+		client: net.ParseIP(clientIPFromContext(ctx)),
+		host:   host,
+		port:   port,
+		ip:     net.ParseIP(host),
+	}
+	if state != nil {
+		q.user = state.name
+	}
+	for _, r := range rt.rules {
+		if !r.matches(q) {
+			continue
+		}
+		debugLog.Printf("rule %d (%s) matched %s:%d", r.index, r.Action, host, port)
+		switch {
+		case r.Action == "direct":
+			return nil, r
+		case r.chain != "":
+			return rt.chains[r.chain], r
+		}
+		return state, r
+	}
+	return state, nil
+}
+
+// blackhole discards whatever the client sends until it closes the
+// connection or stays idle for idleTimeout.
+func blackhole(conn net.Conn) {
+	buf := make([]byte, 4096)
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		if _, err := conn.Read(buf); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withRules validates and installs the routing of cfg for the duration of
+// the test.
+func withRules(t *testing.T, cfg *Config) {
+	t.Helper()
+	if err := validateRules(cfg); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	installRouting(t.Context(), cfg)
+	t.Cleanup(func() { routes.Store(nil) })
+}
+
+func TestRuleMatches(t *testing.T) {
+	tests := []struct {
+		name   string
+		rule   Rule
+		user   string
+		client string
+		host   string
+		port   int
+		want   bool
+	}{
+		{"empty", Rule{}, "", "", "example.com", 80, true},
+		{"domain", Rule{Domain: []string{"Example.com"}}, "", "", "example.com.", 80, true},
+		{"domain subdomain", Rule{Domain: []string{"example.com"}}, "", "", "www.example.com", 80, false},
+		{"suffix", Rule{DomainSuffix: []string{".example.com"}}, "", "", "a.b.example.com", 80, true},
+		{"suffix apex", Rule{DomainSuffix: []string{"example.com"}}, "", "", "example.com", 80, true},
+		{"suffix partial label", Rule{DomainSuffix: []string{"example.com"}}, "", "", "badexample.com", 80, false},
+		{"regex", Rule{DomainRegex: []string{`^ads?\d*\.`}}, "", "", "ads3.example.com", 80, true},
+		{"cidr", Rule{CIDR: []string{"10.0.0.0/8"}}, "", "", "10.1.2.3", 80, true},
+		{"cidr miss", Rule{CIDR: []string{"10.0.0.0/8"}}, "", "", "11.1.2.3", 80, false},
+		{"cidr ignores domains", Rule{CIDR: []string{"10.0.0.0/8"}}, "", "", "example.com", 80, false},
+		{"any destination", Rule{Domain: []string{"example.com"}, CIDR: []string{"10.0.0.0/8"}}, "", "", "10.0.0.1", 80, true},
+		{"port", Rule{Ports: []string{"443"}}, "", "", "example.com", 443, true},
+		{"port range", Rule{Ports: []string{"8000-8999"}}, "", "", "example.com", 8080, true},
+		{"port miss", Rule{Domain: []string{"example.com"}, Ports: []string{"443"}}, "", "", "example.com", 80, false},
+		{"user", Rule{Users: []string{"alice"}}, "alice", "", "example.com", 80, true},
+		{"user miss", Rule{Users: []string{"alice"}}, "bob", "", "example.com", 80, false},
+		{"no user", Rule{Users: []string{"alice"}}, "", "", "example.com", 80, false},
+		{"client", Rule{ClientCIDR: []string{"192.168.0.0/16"}}, "", "192.168.1.1", "example.com", 80, true},
+		{"client miss", Rule{ClientCIDR: []string{"192.168.0.0/16"}}, "", "127.0.0.1", "example.com", 80, false},
+		{"no client", Rule{ClientCIDR: []string{"192.168.0.0/16"}}, "", "", "example.com", 80, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := tt.rule
+			r.Action = "direct"
+			if err := r.compile(); err != nil {
+				t.Fatalf("compile: %v", err)
+			}
+			if got := r.matches(&ruleRequest{user: tt.user, client: net.ParseIP(tt.client), host: tt.host, port: tt.port, ip: net.ParseIP(tt.host)}); got != tt.want {
+				t.Fatalf("matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateRules(t *testing.T) {
+	hop := func() []*Hop { return []*Hop{{Proxies: []*Proxy{{Name: "p", Host: "127.0.0.1", Port: 1080}}}} }
+	tests := []struct {
+		name string
+		cfg  Config
+		want string
+	}{
+		{"ok", Config{
+			NamedChains: []NamedChain{{Name: "eu", Chain: hop()}},
+			Chains:      []UserChain{{Username: "alice"}},
+			Rules: []*Rule{
+				{DomainSuffix: []string{"eu"}, Action: "chain:eu"},
+				{Users: []string{"alice"}, Action: "reject", Reply: 0x05},
+				{Action: "direct"},
+			},
+		}, ""},
+		{"missing action", Config{Rules: []*Rule{{}}}, "rules[0]: action must be"},
+		{"bad action", Config{Rules: []*Rule{{Action: "drop"}}}, "rules[0]: action must be"},
+		{"direct with name", Config{Rules: []*Rule{{Action: "direct:x"}}}, `rules[0]: invalid action "direct:x"`},
+		{"chain without name", Config{Rules: []*Rule{{Action: "chain:"}}}, "rules[0]: action chain requires a name"},
+		{"unknown chain", Config{Rules: []*Rule{{Action: "chain:eu"}}}, `rules[0]: unknown chain "eu"`},
+		{"reply without reject", Config{Rules: []*Rule{{Action: "direct", Reply: 2}}}, "rules[0]: reply requires action reject"},
+		{"bad reply", Config{Rules: []*Rule{{Action: "reject", Reply: 9}}}, "rules[0]: reply must be"},
+		{"bad regex", Config{Rules: []*Rule{{Action: "direct", DomainRegex: []string{"("}}}}, "rules[0]: domain_regex:"},
+		{"bad cidr", Config{Rules: []*Rule{{Action: "direct", CIDR: []string{"10.0.0.0/33"}}}}, "rules[0]: cidr:"},
+		{"bad client cidr", Config{Rules: []*Rule{{Action: "direct", ClientCIDR: []string{"x"}}}}, "rules[0]: client_cidr:"},
+		{"bad port range", Config{Rules: []*Rule{{Action: "direct", Ports: []string{"90-80"}}}}, `rules[0]: ports: invalid port range "90-80"`},
+		{"port out of range", Config{Rules: []*Rule{{Action: "direct", Ports: []string{"70000"}}}}, "rules[0]: ports: invalid port range"},
+		{"unknown user", Config{Rules: []*Rule{{Action: "direct", Users: []string{"bob"}}}}, `rules[0]: user "bob" is not configured`},
+		{"unnamed chain", Config{NamedChains: []NamedChain{{Chain: hop()}}}, "named_chains[0]: name is required"},
+		{"duplicate chain", Config{NamedChains: []NamedChain{{Name: "a", Chain: hop()}, {Name: "a", Chain: hop()}}}, `named_chains[1]: duplicate name "a"`},
+		{"empty chain", Config{NamedChains: []NamedChain{{Name: "a"}}}, "named_chains[0]: chain is required"},
+		{"bad hop", Config{NamedChains: []NamedChain{{Name: "a", Chain: []*Hop{{Pool: "missing"}}}}}, "named_chains[0].chain[0]:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateRules(&tt.cfg)
+			switch {
+			case tt.want == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Fatalf("expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestRouteFirstMatch(t *testing.T) {
+	origDebug := debugLog
+	debugLog = nopLogger{}
+	defer func() { debugLog = origDebug }()
+
+	hop := []*Hop{{Proxies: []*Proxy{{Name: "p", Host: "127.0.0.1", Port: 1080}}}}
+	withRules(t, &Config{
+		Chains:      []UserChain{{Username: "alice"}},
+		NamedChains: []NamedChain{{Name: "eu", Chain: hop}},
+		Rules: []*Rule{
+			{Domain: []string{"blocked.example"}, Action: "reject"},
+			{DomainSuffix: []string{"example"}, Users: []string{"alice"}, Action: "chain:eu"},
+			{DomainSuffix: []string{"example"}, Action: "direct"},
+			{Ports: []string{"25"}, Action: "blackhole"},
+		},
+	})
+	user := &ChainState{name: "alice"}
+	eu := routes.Load().chains["eu"]
+	tests := []struct {
+		host   string
+		port   int
+		state  *ChainState
+		target *ChainState
+		action string
+	}{
+		{"blocked.example", 443, user, user, "reject"},
+		{"www.example", 443, user, eu, "chain:eu"},
+		{"www.example", 443, nil, nil, "direct"},
+		{"other.test", 25, user, user, "blackhole"},
+		{"other.test", 443, user, user, ""},
+	}
+	for _, tt := range tests {
+		target, rule := route(context.Background(), tt.state, tt.host, tt.port)
+		action := ""
+		if rule != nil {
+			action = rule.Action
+		}
+		if target != tt.target || action != tt.action {
+			t.Errorf("%s:%d: got %v/%q, want %v/%q", tt.host, tt.port, target, action, tt.target, tt.action)
+		}
+	}
+}
+
+func TestInstallRoutingKeepsUnchangedChains(t *testing.T) {
+	origWarn := warnLog
+	warnLog = nopLogger{}
+	defer func() { warnLog = origWarn }()
+
+	// Every config is parsed anew on reload, so build each from fresh
+	// proxies.
+	p := func() *Proxy { return &Proxy{Name: "p", Host: "127.0.0.1", Port: 1080, Weight: 2} }
+	cfg := &Config{NamedChains: []NamedChain{
+		{Name: "a", Chain: []*Hop{{Strategy: "weighted", Proxies: []*Proxy{p()}}}},
+		{Name: "b", Chain: []*Hop{{Proxies: []*Proxy{p()}}}},
+		{Name: "c", Chain: []*Hop{{Proxies: []*Proxy{p()}}}},
+	}}
+	initProxies(cfg)
+	withRules(t, cfg)
+	old := routes.Load().chains
+	// Runtime state must not count as a change.
+	old["a"].chain[0].orderedProxies(dialInfo{})
+	old["a"].chain[0].Proxies[0].alive.Store(false)
+
+	next := &Config{NamedChains: []NamedChain{
+		{Name: "a", Chain: []*Hop{{Strategy: "weighted", Proxies: []*Proxy{p()}}}},
+		{Name: "b", Chain: []*Hop{{Proxies: []*Proxy{p()}}, {Proxies: []*Proxy{p()}}}},
+		{Name: "c", Chain: []*Hop{{Proxies: []*Proxy{{Name: "p", Host: "127.0.0.1", Port: 1080, Weight: 3}}}}},
+	}}
+	initProxies(next)
+	installRouting(t.Context(), next)
+	cur := routes.Load().chains
+	if cur["a"] != old["a"] {
+		t.Error("unchanged chain a was replaced")
+	}
+	if cur["b"] == old["b"] {
+		t.Error("changed chain b was kept")
+	}
+	if cur["c"] == old["c"] {
+		t.Error("chain c with a changed weight was kept")
+	}
+}
+
+func TestHandleConnRuleReject(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog = origWarn, origDebug }()
+
+	withRules(t, &Config{Rules: []*Rule{{CIDR: []string{"127.0.0.0/8"}, Action: "reject", Reply: 0x05}}})
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() { handleConn(server, nil, &Listener{}); close(done) }()
+	if code := socks5Connect(t, client, "", "", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80}); code != 0x05 {
+		t.Fatalf("expected reply 0x05, got 0x%02x", code)
+	}
+	client.Close()
+	<-done
+}
+
+func TestHandleConnRuleRejectBind(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog = origWarn, origDebug }()
+
+	withRules(t, &Config{Rules: []*Rule{{CIDR: []string{"127.0.0.0/8"}, Ports: []string{"80"}, Action: "reject", Reply: 0x05}}})
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() { handleConn(server, nil, &Listener{}); close(done) }()
+
+	client.SetDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 10)
+	if _, err := client.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		t.Fatalf("handshake write: %v", err)
+	}
+	if _, err := io.ReadFull(client, buf[:2]); err != nil {
+		t.Fatalf("handshake read: %v", err)
+	}
+	if _, err := client.Write([]byte{0x05, 0x02, 0x00, 0x01, 127, 0, 0, 1, 0, 80}); err != nil {
+		t.Fatalf("bind write: %v", err)
+	}
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatalf("bind read: %v", err)
+	}
+	if buf[1] != 0x05 {
+		t.Fatalf("expected reply 0x05, got 0x%02x", buf[1])
+	}
+	client.Close()
+	<-done
+}
+
+func TestHandleConnRuleUDP(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog = origWarn, origDebug }()
+
+	allowed, rejected, blackholed := startUDPEcho(t), startUDPEcho(t), startUDPEcho(t)
+	defer allowed.Close()
+	defer rejected.Close()
+	defer blackholed.Close()
+	port := func(pc *net.UDPConn) string { return strconv.Itoa(pc.LocalAddr().(*net.UDPAddr).Port) }
+	withRules(t, &Config{Rules: []*Rule{
+		{Ports: []string{port(rejected)}, Action: "reject"},
+		{Ports: []string{port(blackholed)}, Action: "blackhole"},
+	}})
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() { handleConn(server, nil, &Listener{}); close(done) }()
+	relayPort := udpAssociate(t, client)
+
+	uc, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: relayPort})
+	if err != nil {
+		t.Fatalf("dial udp: %v", err)
+	}
+	defer uc.Close()
+	// The relay handles datagrams in order, so by the time the allowed one
+	// is echoed the others have been dropped.
+	for _, echo := range []*net.UDPConn{rejected, blackholed, allowed} {
+		addr := echo.LocalAddr().(*net.UDPAddr)
+		hdr, err := buildUDPHeader(addr.IP.String(), addr.Port)
+		if err != nil {
+			t.Fatalf("header: %v", err)
+		}
+		if _, err := uc.Write(append(hdr, "ping"...)); err != nil {
+			t.Fatalf("udp write: %v", err)
+		}
+	}
+	buf := make([]byte, 1500)
+	uc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := uc.Read(buf)
+	if err != nil {
+		t.Fatalf("udp read: %v", err)
+	}
+	host, p, _, err := parseUDPHeader(buf[:n])
+	if err != nil {
+		t.Fatalf("parse reply: %v", err)
+	}
+	if want := allowed.LocalAddr().(*net.UDPAddr); host != want.IP.String() || p != want.Port {
+		t.Fatalf("reply from %s:%d, want only the allowed destination %s", host, p, want)
+	}
+	uc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := uc.Read(buf); err == nil {
+		t.Fatal("a dropped datagram was relayed")
+	}
+	client.Close()
+	<-done
+}
+
+func TestHandleConnRuleNamedChain(t *testing.T) {
+	origWarn, origDebug, origInfo := warnLog, debugLog, infoLog
+	warnLog, debugLog, infoLog = nopLogger{}, nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog, infoLog = origWarn, origDebug, origInfo }()
+
+	hop := startTestServer(t, &Listener{}, nil)
+	defer hop.Close()
+	target := startPongServer(t)
+	defer target.Close()
+
+	p := &Proxy{Name: "hop", Host: "127.0.0.1", Port: hop.Addr().(*net.TCPAddr).Port}
+	p.alive.Store(true)
+	// alice's own chain is unusable, so only the rule can get her through.
+	dead := &Proxy{Name: "dead", Host: "127.0.0.1", Port: 1}
+	chains := map[string]*ChainState{"alice": {name: "alice", password: "pw", chain: []*Hop{{Proxies: []*Proxy{dead}}}}}
+	withRules(t, &Config{
+		Chains:      []UserChain{{Username: "alice"}},
+		NamedChains: []NamedChain{{Name: "via-hop", Chain: []*Hop{{Proxies: []*Proxy{p}}}}},
+		Rules:       []*Rule{{Users: []string{"alice"}, Action: "chain:via-hop"}},
+	})
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() { handleConn(server, chains, &Listener{}); close(done) }()
+	if code := socks5Connect(t, client, "alice", "pw", target.Addr().(*net.TCPAddr)); code != 0x00 {
+		t.Fatalf("expected success, got 0x%02x", code)
+	}
+	pingPong(t, client)
+	client.Close()
+	<-done
+}
+
+func TestHandleConnRuleBlackhole(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog = origWarn, origDebug }()
+
+	withRules(t, &Config{Rules: []*Rule{{Action: "blackhole"}}})
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() { handleConn(server, nil, &Listener{}); close(done) }()
+	if code := socks5Connect(t, client, "", "", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}); code != 0x00 {
+		t.Fatalf("expected success, got 0x%02x", code)
+	}
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatalf("data write: %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := client.Read(make([]byte, 4)); err == nil {
+		t.Fatalf("expected no data, got %d bytes", n)
+	}
+	client.Close()
+	<-done
+}
+
+func TestHandleConnSocks4RuleReject(t *testing.T) {
+	withRules(t, &Config{Rules: []*Rule{{Domain: []string{"blocked.example"}, Action: "reject"}}})
+	req := socks4Request(net.IPv4(0, 0, 0, 1), 80, "", "blocked.example")
+	socks4Test(t, req, nil, 0x5B)
+}
+
+func TestHandleHTTPConnRuleReject(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog = origWarn, origDebug }()
+
+	withRules(t, &Config{Rules: []*Rule{{Ports: []string{"443"}, Action: "reject"}}})
+	for _, req := range []string{
+		"CONNECT blocked.example:443 HTTP/1.1\r\nHost: blocked.example:443\r\n\r\n",
+		"GET http://blocked.example:443/ HTTP/1.1\r\nHost: blocked.example:443\r\n\r\n",
+	} {
+		client, server := net.Pipe()
+		done := make(chan struct{})
+		go func() { handleHTTPConn(server, nil, &Listener{}); close(done) }()
+		if _, err := io.WriteString(client, req); err != nil {
+			t.Fatalf("request write: %v", err)
+		}
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+		if err != nil {
+			t.Fatalf("response read: %v", err)
+		}
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("%s: expected 403, got %d", strings.Fields(req)[0], resp.StatusCode)
+		}
+		client.Close()
+		<-done
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"io"
 	"net"
@@ -8,11 +9,17 @@ import (
 	"time"
 )
 
-func handleConn(conn net.Conn, chains map[string]*ChainState) {
+func handleConn(conn net.Conn, chains map[string]*ChainState, l *Listener) {
 	defer conn.Close()
 	if tcp, ok := conn.(*net.TCPConn); ok {
 		tcp.SetNoDelay(true)
 	}
+	auth := l.authRequired(chains)
+	chains = l.users(chains)
+	certState, ok := handshakeTLS(conn, chains, l)
+	if !ok {
+		return
+	}
 	buf := make([]byte, 260)
 	conn.SetDeadline(time.Now().Add(ioTimeout))
 	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
@@ -24,7 +31,11 @@ func handleConn(conn net.Conn, chains map[string]*ChainState) {
 		}
 		return
 	}
-	if buf[0] != 0x05 {
+	if buf[0] == 0x04 && (l.Socks4 || l.protocol() == "socks4") {
+		handleSocks4(conn, chains, auth, certState, buf[1])
+		return
+	}
+	if buf[0] != 0x05 || l.protocol() == "socks4" {
 		warnLog.Printf("unsupported version %d, code 0xFF", buf[0])
 		conn.SetDeadline(time.Now().Add(ioTimeout))
 		if err := writeFull(conn, []byte{0x05, 0xFF}); err != nil {
@@ -54,14 +65,16 @@ func handleConn(conn net.Conn, chains map[string]*ChainState) {
 		return
 	}
 	debugLog.Printf("client methods: %v", buf[:nmethods])
-	noAuth := len(chains) == 0
-	want := byte(0x02)
-	if noAuth {
-		want = 0x00
+	// A client certificate mapped to a user stands in for password auth.
+	wants := []byte{0x02}
+	if !auth {
+		wants = []byte{0x00}
+	} else if certState != nil {
+		wants = []byte{0x00, 0x02}
 	}
 	method := byte(0xFF)
-	for i := 0; i < nmethods; i++ {
-		if buf[i] == want {
+	for _, want := range wants {
+		if bytes.IndexByte(buf[:nmethods], want) >= 0 {
 			method = want
 			break
 		}
@@ -82,6 +95,10 @@ func handleConn(conn net.Conn, chains map[string]*ChainState) {
 	}
 	debugLog.Printf("server selected method: 0x%02X", method)
 	var state *ChainState
+	var sess sessionOpts
+	if method == 0x00 {
+		state = certState
+	}
 	if method == 0x02 {
 		conn.SetDeadline(time.Now().Add(ioTimeout))
 		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
@@ -144,8 +161,8 @@ func handleConn(conn net.Conn, chains map[string]*ChainState) {
 			return
 		}
 		passwd := string(buf[:plen])
-		st, ok := chains[uname]
-		if !ok || st.password != passwd {
+		st, opts, ok := lookupUser(chains, uname, passwd)
+		if !ok {
 			warnLog.Printf("authentication failed for user %s, code 0x01", uname)
 			conn.SetDeadline(time.Now().Add(ioTimeout))
 			if err := writeFull(conn, []byte{0x01, 0x01}); err != nil {
@@ -154,7 +171,7 @@ func handleConn(conn net.Conn, chains map[string]*ChainState) {
 			}
 			return
 		}
-		state = st
+		state, sess = st, opts
 		conn.SetDeadline(time.Now().Add(ioTimeout))
 		if err := writeFull(conn, []byte{0x01, 0x00}); err != nil {
 			warnLog.Printf("write: %v", err)
@@ -175,7 +192,8 @@ func handleConn(conn net.Conn, chains map[string]*ChainState) {
 	if buf[0] != 0x05 {
 		return
 	}
-	if buf[1] != 0x01 { // CONNECT only
+	cmd := buf[1]
+	if cmd != 0x01 && cmd != 0x02 && cmd != 0x03 { // CONNECT, BIND and UDP ASSOCIATE
 		conn.SetDeadline(time.Now().Add(ioTimeout))
 		if err := writeFull(conn, []byte{0x05, 0x07, 0x00, 0x01, 0, 0, 0, 0, 0, 0}); err != nil {
 			warnLog.Printf("write: %v", err)
@@ -222,20 +240,44 @@ func handleConn(conn net.Conn, chains map[string]*ChainState) {
 		return
 	}
 	port := int(buf[0])<<8 | int(buf[1])
+	if cmd != 0x01 && l.isUnix() {
+		// BIND and UDP ASSOCIATE open sockets on the network, which
+		// clients of a unix socket have no address to be checked against.
+		warnLog.Printf("%s not supported on unix socket listeners, code 0x07", cmdName(cmd))
+		conn.SetDeadline(time.Now().Add(ioTimeout))
+		if err := writeFull(conn, encodeReply(0x07, "0.0.0.0", 0)); err != nil {
+			warnLog.Printf("write: %v", err)
+		}
+		return
+	}
+	sctx := withSession(clientContext(conn), sess)
 	dest := net.JoinHostPort(host, strconv.Itoa(port))
-	debugLog.Printf("connect request to %s", dest)
-	ctx, cancel := context.WithTimeout(context.Background(), ioTimeout)
+	switch cmd {
+	case 0x02:
+		debugLog.Printf("bind request for %s", dest)
+	case 0x03:
+		// Datagrams are routed one by one as they arrive.
+		debugLog.Printf("udp associate request from %s", dest)
+		handleUDPAssociate(sctx, conn, state)
+		return
+	default:
+		debugLog.Printf("connect request to %s", dest)
+	}
+	ctx, cancel := context.WithTimeout(sctx, ioTimeout)
 	defer cancel()
-	var remote net.Conn
-	var err error
-	if state != nil && len(state.chain) > 0 {
-		state.acquire()
-		defer state.release()
-		remote, err = dialChain(ctx, state, host, port)
-	} else {
-		d := net.Dialer{}
-		remote, err = d.DialContext(ctx, "tcp", dest)
+	target, rule := route(ctx, state, host, port)
+	if applyRule(conn, cmd, dest, rule) {
+		return
+	}
+	if cmd == 0x02 {
+		handleBind(sctx, conn, target, host, port)
+		return
+	}
+	if target != nil {
+		target.acquire()
+		defer target.release()
 	}
+	remote, err := dialTarget(ctx, target, host, port)
 	if err != nil {
 		warnLog.Printf("connect to %s failed: %v, code 0x04", dest, err)
 		conn.SetDeadline(time.Now().Add(ioTimeout))
@@ -250,15 +292,7 @@ func handleConn(conn net.Conn, chains map[string]*ChainState) {
 	}
 	defer remote.Close()
 	la := remote.LocalAddr().(*net.TCPAddr)
-	lip := la.IP.To4()
-	atyp = 0x01
-	if lip == nil {
-		lip = la.IP
-		atyp = 0x04
-	}
-	resp := []byte{0x05, 0x00, 0x00, atyp}
-	resp = append(resp, lip...)
-	resp = append(resp, byte(la.Port>>8), byte(la.Port))
+	resp := encodeReply(0x00, la.IP.String(), la.Port)
 	conn.SetDeadline(time.Now().Add(ioTimeout))
 	if err := writeFull(conn, resp); err != nil {
 		warnLog.Printf("write: %v", err)
@@ -270,3 +304,49 @@ func handleConn(conn net.Conn, chains map[string]*ChainState) {
 	debugLog.Printf("server responded with %v", resp)
 	proxy(remote, conn)
 }
+
+// applyRule answers a request that rule rejects or blackholes and reports
+// whether it did.
+func applyRule(conn net.Conn, cmd byte, dest string, rule *Rule) bool {
+	switch {
+	case rule.rejects():
+		warnLog.Printf("%s to %s rejected by rules[%d], code 0x%02x", cmdName(cmd), dest, rule.index, rule.replyCode())
+		conn.SetDeadline(time.Now().Add(ioTimeout))
+		if err := writeFull(conn, encodeReply(rule.replyCode(), "0.0.0.0", 0)); err != nil {
+			warnLog.Printf("write: %v", err)
+		}
+	case rule.blackholes():
+		debugLog.Printf("%s to %s blackholed by rules[%d]", cmdName(cmd), dest, rule.index)
+		conn.SetDeadline(time.Now().Add(ioTimeout))
+		if err := writeFull(conn, encodeReply(0x00, "0.0.0.0", 0)); err != nil {
+			warnLog.Printf("write: %v", err)
+			return true
+		}
+		blackhole(conn)
+	default:
+		return false
+	}
+	return true
+}
+
+// dialTarget connects to host:port through the user's chain, or directly
+// when there is no chain.
+func dialTarget(ctx context.Context, state *ChainState, host string, port int) (net.Conn, error) {
+	if state != nil && len(state.chain) > 0 {
+		return dialChain(ctx, state, host, port)
+	}
+	d := net.Dialer{}
+	return d.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// encodeReply builds a SOCKS5 reply carrying the given bound address.
+func encodeReply(rep byte, host string, port int) []byte {
+	atyp, addr, err := encodeAddr(host)
+	if err != nil {
+		atyp, addr = 0x01, []byte{0, 0, 0, 0}
+	}
+	resp := []byte{0x05, rep, 0x00, atyp}
+	resp = append(resp, addr...)
+	resp = append(resp, byte(port>>8), byte(port))
+	return resp
+}
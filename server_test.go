@@ -18,7 +18,7 @@ func handshakeTest(t *testing.T, req, want []byte, chains map[string]*ChainState
 	client, server := net.Pipe()
 	done := make(chan struct{})
 	go func() {
-		handleConn(server, chains)
+		handleConn(server, chains, &Listener{})
 		close(done)
 	}()
 
@@ -44,6 +44,89 @@ func handshakeTest(t *testing.T, req, want []byte, chains map[string]*ChainState
 	client.Close()
 }
 
+// startTestServer serves the handler for l on a loopback listener, for use
+// as an upstream hop in chain tests.
+func startTestServer(t *testing.T, l *Listener, chains map[string]*ChainState) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go l.handler()(c, chains, l)
+		}
+	}()
+	return ln
+}
+
+// socks5Connect authenticates as user/pass (or without auth when user is
+// empty) and sends a CONNECT request for addr. It returns the reply code.
+func socks5Connect(t *testing.T, client net.Conn, user, pass string, addr *net.TCPAddr) byte {
+	t.Helper()
+	method := byte(0x00)
+	if user != "" {
+		method = 0x02
+	}
+	if _, err := client.Write([]byte{0x05, 0x01, method}); err != nil {
+		t.Fatalf("handshake write: %v", err)
+	}
+	buf := make([]byte, 10)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(client, buf[:2]); err != nil {
+		t.Fatalf("handshake read: %v", err)
+	}
+	if buf[1] != method {
+		t.Fatalf("expected method 0x%02X, got 0x%02X", method, buf[1])
+	}
+	if user != "" {
+		auth := append([]byte{0x01, byte(len(user))}, user...)
+		auth = append(auth, byte(len(pass)))
+		auth = append(auth, pass...)
+		if _, err := client.Write(auth); err != nil {
+			t.Fatalf("auth write: %v", err)
+		}
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(client, buf[:2]); err != nil {
+			t.Fatalf("auth read: %v", err)
+		}
+		if buf[1] != 0x00 {
+			t.Fatalf("auth failed: 0x%02X", buf[1])
+		}
+	}
+	req := []byte{0x05, 0x01, 0x00, 0x01}
+	req = append(req, addr.IP.To4()...)
+	req = append(req, byte(addr.Port>>8), byte(addr.Port))
+	if _, err := client.Write(req); err != nil {
+		t.Fatalf("connect write: %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatalf("connect read: %v", err)
+	}
+	return buf[1]
+}
+
+// pingPong sends "ping" on client and expects "pong" back.
+func pingPong(t *testing.T, client net.Conn) {
+	t.Helper()
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatalf("data write: %v", err)
+	}
+	buf := make([]byte, 4)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatalf("data read: %v", err)
+	}
+	if string(buf) != "pong" {
+		t.Fatalf("unexpected data %q", buf)
+	}
+}
+
 func TestHandleConnBadVersion(t *testing.T) {
 	handshakeTest(t, []byte{0x04, 0x01}, []byte{0x05, 0xFF}, nil)
 }
@@ -91,7 +174,7 @@ func TestHandleConnConnectNoAuth(t *testing.T) {
 
 	client, server := net.Pipe()
 	done := make(chan struct{})
-	go func() { handleConn(server, nil); close(done) }()
+	go func() { handleConn(server, nil, &Listener{}); close(done) }()
 
 	// handshake
 	if _, err := client.Write([]byte{0x05, 0x01, 0x00}); err != nil {
@@ -172,7 +255,7 @@ func TestHandleConnConnectWithAuth(t *testing.T) {
 	chains := map[string]*ChainState{"user": {password: "pass"}}
 	client, server := net.Pipe()
 	done := make(chan struct{})
-	go func() { handleConn(server, chains); close(done) }()
+	go func() { handleConn(server, chains, &Listener{}); close(done) }()
 
 	// handshake with auth
 	if _, err := client.Write([]byte{0x05, 0x01, 0x02}); err != nil {
@@ -253,7 +336,7 @@ func TestHandleConnConnectFail(t *testing.T) {
 
 	client, server := net.Pipe()
 	done := make(chan struct{})
-	go func() { handleConn(server, nil); close(done) }()
+	go func() { handleConn(server, nil, &Listener{}); close(done) }()
 
 	if _, err := client.Write([]byte{0x05, 0x01, 0x00}); err != nil {
 		t.Fatalf("handshake write: %v", err)
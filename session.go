@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSessionTTL = 10 * time.Minute
+	maxSessionTTL     = 24 * time.Hour
+)
+
+// sessionOpts are connection options a client encodes in its username,
+// as in "alice-session-abc123-ttl-10m-country-us".
+type sessionOpts struct {
+	id      string
+	ttl     time.Duration
+	group   string
+	country string
+}
+
+type sessionKey struct{}
+
+func withSession(ctx context.Context, s sessionOpts) context.Context {
+	return context.WithValue(ctx, sessionKey{}, s)
+}
+
+func sessionFromContext(ctx context.Context) sessionOpts {
+	s, _ := ctx.Value(sessionKey{}).(sessionOpts)
+	return s
+}
+
+// parseUsername splits uname into a configured user and the options that
+// follow it. A configured user matching uname exactly takes precedence, so
+// usernames containing dashes keep working.
+func parseUsername(chains map[string]*ChainState, uname string) (string, sessionOpts, bool) {
+	if _, ok := chains[uname]; ok {
+		return uname, sessionOpts{}, true
+	}
+	parts := strings.Split(uname, "-")
+	for i := 1; i < len(parts); i++ {
+		base := strings.Join(parts[:i], "-")
+		if _, ok := chains[base]; !ok {
+			continue
+		}
+		opts, err := parseSessionOpts(parts[i:])
+		if err != nil {
+			debugLog.Printf("username options for %s: %v", base, err)
+			continue
+		}
+		return base, opts, true
+	}
+	return "", sessionOpts{}, false
+}
+
+func parseSessionOpts(kv []string) (sessionOpts, error) {
+	var s sessionOpts
+	if len(kv)%2 != 0 {
+		return s, fmt.Errorf("options must be key-value pairs")
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < len(kv); i += 2 {
+		key, val := strings.ToLower(kv[i]), kv[i+1]
+		if seen[key] {
+			return s, fmt.Errorf("duplicate option %q", key)
+		}
+		seen[key] = true
+		if val == "" {
+			return s, fmt.Errorf("empty value for %q", key)
+		}
+		switch key {
+		case "session":
+			s.id = val
+		case "ttl":
+			d, err := time.ParseDuration(val)
+			if err != nil || d <= 0 || d > maxSessionTTL {
+				return s, fmt.Errorf("ttl must be a duration up to %s", maxSessionTTL)
+			}
+			s.ttl = d
+		case "group":
+			s.group = val
+		case "country":
+			s.country = strings.ToLower(val)
+		default:
+			return s, fmt.Errorf("unknown option %q", key)
+		}
+	}
+	if s.ttl > 0 && s.id == "" {
+		return s, fmt.Errorf("ttl requires a session")
+	}
+	if s.id != "" && s.ttl == 0 {
+		s.ttl = defaultSessionTTL
+	}
+	return s, nil
+}
+
+// lookupUser authenticates uname, which may carry session options, with
+// passwd against the configured users.
+func lookupUser(chains map[string]*ChainState, uname, passwd string) (*ChainState, sessionOpts, bool) {
+	base, opts, ok := parseUsername(chains, uname)
+	if !ok {
+		return nil, sessionOpts{}, false
+	}
+	st := chains[base]
+	if st.password != passwd {
+		return nil, sessionOpts{}, false
+	}
+	return st, opts, true
+}
+
+// preferTagged moves the proxies matching the requested group and country
+// to the front, keeping the others as fallbacks.
+func (h *Hop) preferTagged(proxies []*Proxy, info dialInfo) []*Proxy {
+	if info.group == "" && info.country == "" {
+		return proxies
+	}
+	matches := func(p *Proxy) bool {
+		m := h.member(p)
+		return (info.group == "" || m.group == info.group) &&
+			(info.country == "" || strings.EqualFold(m.country, info.country))
+	}
+	ordered := make([]*Proxy, 0, len(proxies))
+	for _, p := range proxies {
+		if matches(p) {
+			ordered = append(ordered, p)
+		}
+	}
+	for _, p := range proxies {
+		if !matches(p) {
+			ordered = append(ordered, p)
+		}
+	}
+	return ordered
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseUsername(t *testing.T) {
+	origDebug := debugLog
+	debugLog = nopLogger{}
+	defer func() { debugLog = origDebug }()
+
+	chains := map[string]*ChainState{"alice": {}, "team-a": {}, "team-a-session-x": {}}
+	tests := []struct {
+		uname    string
+		wantUser string
+		want     sessionOpts
+		wantOK   bool
+	}{
+		{uname: "alice", wantUser: "alice", wantOK: true},
+		{uname: "alice-session-abc123", wantUser: "alice", want: sessionOpts{id: "abc123", ttl: defaultSessionTTL}, wantOK: true},
+		{uname: "alice-session-abc-ttl-30s-country-US", wantUser: "alice", want: sessionOpts{id: "abc", ttl: 30 * time.Second, country: "us"}, wantOK: true},
+		{uname: "team-a-group-fast", wantUser: "team-a", want: sessionOpts{group: "fast"}, wantOK: true},
+		{uname: "team-a-session-x", wantUser: "team-a-session-x", wantOK: true},
+		{uname: "alice-ttl-10m"},
+		{uname: "alice-session"},
+		{uname: "alice-session-a-ttl-forever"},
+		{uname: "alice-session-a-session-b"},
+		{uname: "alice-color-red"},
+		{uname: "bob-session-a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.uname, func(t *testing.T) {
+			user, opts, ok := parseUsername(chains, tt.uname)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && (user != tt.wantUser || opts != tt.want) {
+				t.Fatalf("got %q %+v, want %q %+v", user, opts, tt.wantUser, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreferTagged(t *testing.T) {
+	p1 := &Proxy{Name: "p1", Country: "DE"}
+	p2 := &Proxy{Name: "p2", Country: "US", Group: "fast"}
+	p3 := &Proxy{Name: "p3", Country: "US"}
+	res := (&Hop{}).preferTagged([]*Proxy{p1, p2, p3}, dialInfo{country: "us"})
+	if res[0] != p2 || res[1] != p3 || res[2] != p1 {
+		t.Fatalf("unexpected order %v", res)
+	}
+	res = (&Hop{}).preferTagged([]*Proxy{p1, p2, p3}, dialInfo{country: "us", group: "fast"})
+	if res[0] != p2 {
+		t.Fatalf("unexpected order %v", res)
+	}
+}
+
+func TestSessionPinning(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog = origWarn, origDebug }()
+
+	target := startPongServer(t)
+	defer target.Close()
+	var proxies []*Proxy
+	for i := 0; i < 2; i++ {
+		hop := startTestServer(t, &Listener{}, nil)
+		defer hop.Close()
+		proxies = append(proxies, &Proxy{Name: hop.Addr().String(), Host: "127.0.0.1", Port: hop.Addr().(*net.TCPAddr).Port})
+	}
+	cfg := Config{Chains: []UserChain{{Username: "u", Chain: []*Hop{{Proxies: proxies}}}}}
+	initProxies(&cfg)
+	state := &ChainState{name: "u", chain: cfg.Chains[0].Chain}
+	port := target.Addr().(*net.TCPAddr).Port
+
+	dial := func(id string) *Proxy {
+		t.Helper()
+		ctx := withSession(context.Background(), sessionOpts{id: id, ttl: time.Minute})
+		conn, err := dialChain(ctx, state, "127.0.0.1", port)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer conn.Close()
+		return conn.(*chainConn).combo[0]
+	}
+	a := dial("a")
+	b := dial("b")
+	if a == b {
+		t.Fatal("sessions a and b share an exit")
+	}
+	for i := 0; i < 3; i++ {
+		if got := dial("a"); got != a {
+			t.Fatalf("session a moved from %s to %s", a.Name, got.Name)
+		}
+	}
+	if state.destCache().len() != 0 {
+		t.Fatal("sessions should not touch the destination cache")
+	}
+
+	state.sessionCache().mu.Lock()
+	state.sessionCache().entries["a"].Value.(*cachedChain).lastUsed = time.Now().Add(-2 * time.Minute)
+	state.sessionCache().mu.Unlock()
+	if state.sessionCache().get("a") != nil || state.sessionCache().get("b") == nil {
+		t.Fatal("expected only session a to expire")
+	}
+}
+
+func TestSessionCacheCapped(t *testing.T) {
+	origDebug, origSize := debugLog, chainCacheSize
+	debugLog, chainCacheSize = nopLogger{}, 2
+	defer func() { debugLog, chainCacheSize = origDebug, origSize }()
+
+	state := &ChainState{}
+	p := &Proxy{Name: "p"}
+	for _, id := range []string{"a", "b", "c"} {
+		state.sessionCache().putTTL(id, []*Proxy{p}, time.Minute)
+	}
+	if n := state.sessionCache().len(); n != 2 {
+		t.Fatalf("cache holds %d sessions, want 2", n)
+	}
+	if state.sessionCache().get("a") != nil {
+		t.Fatal("expected the oldest session to be evicted")
+	}
+}
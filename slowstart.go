@@ -0,0 +1,50 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// slowStart is how long a recovered proxy takes to get back to its full
+// share of new connections. Zero disables the ramp.
+var slowStart time.Duration
+
+func (p *Proxy) markRecovered() {
+	p.recoveredAt.Store(time.Now().UnixNano())
+}
+
+// slowStartFactor returns the share of its normal traffic p should receive
+// at now, growing linearly from 0 to 1 over slowStart after a recovery.
+func (p *Proxy) slowStartFactor(now time.Time) float64 {
+	at := p.recoveredAt.Load()
+	if slowStart <= 0 || at == 0 {
+		return 1
+	}
+	elapsed := now.Sub(time.Unix(0, at))
+	if elapsed >= slowStart {
+		return 1
+	}
+	return float64(elapsed) / float64(slowStart)
+}
+
+// applySlowStart moves each proxy still ramping up behind the others with
+// a probability matching how far it is from full share, whatever order the
+// hop's strategy chose. Demoted proxies remain available as fallbacks.
+func applySlowStart(proxies []*Proxy) []*Proxy {
+	if slowStart <= 0 {
+		return proxies
+	}
+	now := time.Now()
+	var kept, demoted []*Proxy
+	for _, p := range proxies {
+		if f := p.slowStartFactor(now); f < 1 && rand.Float64() >= f {
+			demoted = append(demoted, p)
+		} else {
+			kept = append(kept, p)
+		}
+	}
+	if len(demoted) == 0 {
+		return proxies
+	}
+	return append(kept, demoted...)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlowStart(t *testing.T) {
+	orig := slowStart
+	slowStart = time.Hour
+	defer func() { slowStart = orig }()
+
+	a, b := aliveProxy("a"), aliveProxy("b")
+	a.markRecovered()
+	if f := a.slowStartFactor(time.Now().Add(30 * time.Minute)); f < 0.49 || f > 0.51 {
+		t.Fatalf("expected half share halfway through, got %v", f)
+	}
+	if f := b.slowStartFactor(time.Now()); f != 1 {
+		t.Fatalf("proxy that never recovered should have full share, got %v", f)
+	}
+	if res := applySlowStart([]*Proxy{a, b}); res[0] != b || res[1] != a {
+		t.Fatalf("freshly recovered proxy should be tried last, got %s,%s", res[0].Name, res[1].Name)
+	}
+	a.recoveredAt.Store(time.Now().Add(-2 * time.Hour).UnixNano())
+	if res := applySlowStart([]*Proxy{a, b}); res[0] != a {
+		t.Fatal("ramp should be over after slow_start")
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// handleSocks4 serves a SOCKS4 or SOCKS4a request whose version byte and
+// command code have already been read from conn. certState, when set, is
+// the user identified by a TLS client certificate and replaces the USERID;
+// without auth the USERID is ignored.
+func handleSocks4(conn net.Conn, chains map[string]*ChainState, auth bool, certState *ChainState, cmd byte) {
+	buf := make([]byte, 6)
+	conn.SetDeadline(time.Now().Add(ioTimeout))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		warnLog.Printf("socks4 request: %v, code 0x5B", err)
+		writeSocks4Reply(conn, 0x5B)
+		return
+	}
+	port := int(buf[0])<<8 | int(buf[1])
+	ip := net.IP(buf[2:6])
+	userID, err := readCString(conn, 255)
+	if err != nil {
+		warnLog.Printf("socks4 userid: %v, code 0x5B", err)
+		writeSocks4Reply(conn, 0x5B)
+		return
+	}
+	host := ip.String()
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 { // SOCKS4a
+		host, err = readCString(conn, 255)
+		if err != nil {
+			warnLog.Printf("socks4a domain: %v, code 0x5B", err)
+			writeSocks4Reply(conn, 0x5B)
+			return
+		}
+	}
+	if cmd != 0x01 { // CONNECT only
+		warnLog.Printf("socks4 command %d not supported, code 0x5B", cmd)
+		writeSocks4Reply(conn, 0x5B)
+		return
+	}
+	state, ok := certState, true
+	if state == nil && auth {
+		state, ok = socks4User(chains, userID)
+	}
+	if !ok {
+		uname, _, _ := strings.Cut(userID, ":")
+		warnLog.Printf("authentication failed for user %s, code 0x5B", uname)
+		writeSocks4Reply(conn, 0x5B)
+		return
+	}
+	dest := net.JoinHostPort(host, strconv.Itoa(port))
+	debugLog.Printf("socks4 connect request to %s", dest)
+	ctx, cancel := context.WithTimeout(clientContext(conn), ioTimeout)
+	defer cancel()
+	target, rule := route(ctx, state, host, port)
+	if rule.rejects() {
+		warnLog.Printf("connect to %s rejected by rules[%d], code 0x5B", dest, rule.index)
+		writeSocks4Reply(conn, 0x5B)
+		return
+	}
+	if rule.blackholes() {
+		debugLog.Printf("connect to %s blackholed by rules[%d]", dest, rule.index)
+		if writeSocks4Reply(conn, 0x5A) {
+			blackhole(conn)
+		}
+		return
+	}
+	if target != nil {
+		target.acquire()
+		defer target.release()
+	}
+	remote, err := dialTarget(ctx, target, host, port)
+	if err != nil {
+		warnLog.Printf("connect to %s failed: %v, code 0x5B", dest, err)
+		writeSocks4Reply(conn, 0x5B)
+		return
+	}
+	if tcp, ok := remote.(*net.TCPConn); ok {
+		tcp.SetNoDelay(true)
+	}
+	defer remote.Close()
+	if !writeSocks4Reply(conn, 0x5A) {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	remote.SetDeadline(time.Time{})
+	proxy(remote, conn)
+}
+
+// socks4User maps a SOCKS4 USERID onto the configured users. SOCKS4 has no
+// password field, so the USERID may carry one as "username:password"; a
+// bare username only matches users without a password.
+func socks4User(chains map[string]*ChainState, userID string) (*ChainState, bool) {
+	uname, passwd, _ := strings.Cut(userID, ":")
+	st, ok := chains[uname]
+	if !ok || st.password != passwd {
+		return nil, false
+	}
+	return st, true
+}
+
+// socks4ConnectHop sends a SOCKS4 CONNECT request for host:port over conn.
+// Plain SOCKS4 needs an IPv4 address, so domain names are resolved locally
+// unless remoteDNS selects the SOCKS4a form that lets the hop resolve them.
+func socks4ConnectHop(ctx context.Context, conn net.Conn, hop *Proxy, host string, port int, remoteDNS bool, timeout time.Duration) error {
+	var domain string
+	ip := net.ParseIP(host)
+	switch {
+	case ip != nil && ip.To4() == nil:
+		return fmt.Errorf("hop %s: socks4 does not support IPv6 address %s", hop.Name, host)
+	case ip == nil && remoteDNS:
+		domain = host
+		ip = net.IPv4(0, 0, 0, 1)
+	case ip == nil:
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+		cancel()
+		if err != nil {
+			return &targetError{err}
+		}
+		ip = ips[0]
+	}
+	userID := hop.Username
+	if hop.Password != "" {
+		userID += ":" + hop.Password
+	}
+	req := []byte{0x04, 0x01, byte(port >> 8), byte(port)}
+	req = append(req, ip.To4()...)
+	req = append(req, userID...)
+	req = append(req, 0)
+	if domain != "" {
+		req = append(req, domain...)
+		req = append(req, 0)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := writeFull(conn, req); err != nil {
+		return err
+	}
+	resp := make([]byte, 8)
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if resp[0] != 0x00 {
+		return fmt.Errorf("bad socks4 reply version %d", resp[0])
+	}
+	switch resp[1] {
+	case 0x5A:
+	case 0x5B:
+		return &targetError{fmt.Errorf("connect failed on hop %s: code 0x%02X", hop.Name, resp[1])}
+	default:
+		return fmt.Errorf("connect failed on hop %s: code 0x%02X", hop.Name, resp[1])
+	}
+	return nil
+}
+
+func writeSocks4Reply(conn net.Conn, code byte) bool {
+	conn.SetDeadline(time.Now().Add(ioTimeout))
+	if err := writeFull(conn, []byte{0x00, code, 0, 0, 0, 0, 0, 0}); err != nil {
+		warnLog.Printf("write: %v", err)
+		return false
+	}
+	return true
+}
+
+// readCString reads a NUL-terminated string of at most max bytes.
+func readCString(conn net.Conn, max int) (string, error) {
+	var b strings.Builder
+	c := make([]byte, 1)
+	for {
+		conn.SetDeadline(time.Now().Add(ioTimeout))
+		if _, err := io.ReadFull(conn, c); err != nil {
+			return "", err
+		}
+		if c[0] == 0 {
+			return b.String(), nil
+		}
+		if b.Len() >= max {
+			return "", fmt.Errorf("string longer than %d bytes", max)
+		}
+		b.WriteByte(c[0])
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startPongServer accepts one connection, expects "ping" and answers "pong".
+func startPongServer(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(c, buf); err == nil && string(buf) == "ping" {
+			c.Write([]byte("pong"))
+		}
+	}()
+	return ln
+}
+
+func socks4Test(t *testing.T, req []byte, chains map[string]*ChainState, wantCode byte) {
+	t.Helper()
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog = origWarn, origDebug }()
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() { handleConn(server, chains, &Listener{Socks4: true}); close(done) }()
+
+	if _, err := client.Write(req); err != nil {
+		t.Fatalf("request write: %v", err)
+	}
+	resp := make([]byte, 8)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(client, resp); err != nil {
+		t.Fatalf("reply read: %v", err)
+	}
+	if resp[0] != 0x00 || resp[1] != wantCode {
+		t.Fatalf("unexpected reply %v, want code 0x%02X", resp, wantCode)
+	}
+	if wantCode == 0x5A {
+		if _, err := client.Write([]byte("ping")); err != nil {
+			t.Fatalf("data write: %v", err)
+		}
+		buf := make([]byte, 4)
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(client, buf); err != nil {
+			t.Fatalf("data read: %v", err)
+		}
+		if string(buf) != "pong" {
+			t.Fatalf("unexpected data %q", buf)
+		}
+	}
+	client.Close()
+	<-done
+}
+
+func socks4Request(ip net.IP, port int, userID, domain string) []byte {
+	req := []byte{0x04, 0x01, byte(port >> 8), byte(port)}
+	req = append(req, ip.To4()...)
+	req = append(req, userID...)
+	req = append(req, 0)
+	if domain != "" {
+		req = append(req, domain...)
+		req = append(req, 0)
+	}
+	return req
+}
+
+func TestHandleConnSocks4Connect(t *testing.T) {
+	ln := startPongServer(t)
+	defer ln.Close()
+	addr := ln.Addr().(*net.TCPAddr)
+	socks4Test(t, socks4Request(addr.IP, addr.Port, "", ""), nil, 0x5A)
+}
+
+func TestHandleConnSocks4aConnect(t *testing.T) {
+	ln := startPongServer(t)
+	defer ln.Close()
+	addr := ln.Addr().(*net.TCPAddr)
+	req := socks4Request(net.IPv4(0, 0, 0, 1), addr.Port, "", "127.0.0.1")
+	socks4Test(t, req, nil, 0x5A)
+}
+
+func TestHandleConnSocks4UserID(t *testing.T) {
+	ln := startPongServer(t)
+	defer ln.Close()
+	addr := ln.Addr().(*net.TCPAddr)
+	chains := map[string]*ChainState{"user": {password: "pass"}}
+	socks4Test(t, socks4Request(addr.IP, addr.Port, "user:pass", ""), chains, 0x5A)
+	socks4Test(t, socks4Request(addr.IP, addr.Port, "user", ""), chains, 0x5B)
+	socks4Test(t, socks4Request(addr.IP, addr.Port, "user:bad", ""), chains, 0x5B)
+	socks4Test(t, socks4Request(addr.IP, addr.Port, "nobody", ""), chains, 0x5B)
+}
+
+func TestHandleConnSocks4Bind(t *testing.T) {
+	req := socks4Request(net.IPv4(127, 0, 0, 1), 1, "", "")
+	req[1] = 0x02
+	socks4Test(t, req, nil, 0x5B)
+}
+
+func TestConnectThroughSocks4Hop(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog = origWarn, origDebug }()
+
+	hop := startTestServer(t, &Listener{Socks4: true}, map[string]*ChainState{"hu": {password: "hp"}})
+	defer hop.Close()
+	hopPort := hop.Addr().(*net.TCPAddr).Port
+
+	for _, typ := range []string{"socks4", "socks4a"} {
+		t.Run(typ, func(t *testing.T) {
+			target := startPongServer(t)
+			defer target.Close()
+			p := &Proxy{Name: "s4", Type: typ, Username: "hu", Password: "hp", Host: "127.0.0.1", Port: hopPort}
+			conn, err := connectThrough(t.Context(), []*Proxy{p}, "localhost", target.Addr().(*net.TCPAddr).Port)
+			if err != nil {
+				t.Fatalf("connect: %v", err)
+			}
+			defer conn.Close()
+			pingPong(t, conn)
+		})
+	}
+}
+
+func TestConnectThroughSocks4HopRejected(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog = origWarn, origDebug }()
+
+	hop := startTestServer(t, &Listener{Socks4: true}, map[string]*ChainState{"hu": {password: "hp"}})
+	defer hop.Close()
+
+	p := &Proxy{Name: "s4", Type: "socks4", Username: "hu", Password: "bad", Host: "127.0.0.1", Port: hop.Addr().(*net.TCPAddr).Port}
+	if _, err := connectThrough(t.Context(), []*Proxy{p}, "127.0.0.1", 1); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := connectThrough(t.Context(), []*Proxy{p}, "2001:db8::1", 1); err == nil {
+		t.Fatal("expected error for IPv6 target")
+	}
+}
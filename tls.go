@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+func validateListenerTLS(t *ListenerTLS) error {
+	if t == nil || !t.Enabled {
+		return nil
+	}
+	if t.CertFile == "" || t.KeyFile == "" {
+		return fmt.Errorf("tls.cert_file and tls.key_file are required")
+	}
+	switch strings.ToLower(t.ClientAuth) {
+	case "", "none":
+	case "optional", "require":
+		if t.ClientCAFile == "" {
+			return fmt.Errorf("tls.client_ca_file is required with client_auth %q", t.ClientAuth)
+		}
+	default:
+		return fmt.Errorf("tls.client_auth: invalid value %q", t.ClientAuth)
+	}
+	switch strings.ToLower(t.CertUser) {
+	case "", "none":
+	case "cn", "san", "any":
+		if t.ClientCAFile == "" {
+			return fmt.Errorf("tls.client_ca_file is required with cert_user %q", t.CertUser)
+		}
+	default:
+		return fmt.Errorf("tls.cert_user: invalid value %q", t.CertUser)
+	}
+	return nil
+}
+
+// buildListenerTLS builds the server configuration for a TLS listener.
+// Client certificates are verified against client_ca_file; client_auth
+// defaults to "optional" when a CA file is given.
+func buildListenerTLS(t *ListenerTLS) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if t.ClientCAFile != "" {
+		pool, err := loadCertPool(t.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	switch strings.ToLower(t.ClientAuth) {
+	case "none":
+		conf.ClientAuth = tls.NoClientCert
+	case "require":
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
+
+// handshakeTLS completes the handshake when conn is a TLS connection and
+// returns the user its client certificate maps to, if any.
+func handshakeTLS(conn net.Conn, chains map[string]*ChainState, l *Listener) (*ChainState, bool) {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, true
+	}
+	conn.SetDeadline(time.Now().Add(ioTimeout))
+	if err := tc.Handshake(); err != nil {
+		warnLog.Printf("tls handshake: %v", err)
+		return nil, false
+	}
+	var mode string
+	if l.TLS != nil {
+		mode = l.TLS.CertUser
+	}
+	uname, st := certUser(tc.ConnectionState(), chains, mode)
+	if st != nil {
+		debugLog.Printf("client certificate maps to user %s", uname)
+	}
+	return st, true
+}
+
+// certUser maps the verified client certificate of a TLS connection to a
+// configured user according to mode: "cn" uses the subject common name,
+// "san" the DNS, email and URI SANs, and "any" tries both.
+func certUser(cs tls.ConnectionState, chains map[string]*ChainState, mode string) (string, *ChainState) {
+	if len(cs.VerifiedChains) == 0 || len(cs.PeerCertificates) == 0 {
+		return "", nil
+	}
+	mode = strings.ToLower(mode)
+	if mode == "" || mode == "none" {
+		return "", nil
+	}
+	cert := cs.PeerCertificates[0]
+	var names []string
+	if mode == "cn" || mode == "any" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	if mode == "san" || mode == "any" {
+		names = append(names, cert.DNSNames...)
+		names = append(names, cert.EmailAddresses...)
+		for _, u := range cert.URIs {
+			names = append(names, u.String())
+		}
+	}
+	for _, name := range names {
+		if st, ok := chains[name]; ok && name != "" {
+			return name, st
+		}
+	}
+	return "", nil
+}
+
+func validateProxyTLS(t *ProxyTLS) error {
+	if t == nil || !t.Enabled {
+		return nil
+	}
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return fmt.Errorf("tls.cert_file and tls.key_file must be set together")
+	}
+	if t.PinSHA256 != "" {
+		if _, err := decodePin(t.PinSHA256); err != nil {
+			return fmt.Errorf("tls.pin_sha256: %w", err)
+		}
+	}
+	return nil
+}
+
+// buildProxyTLS turns the TLS settings of an upstream proxy into a client
+// configuration. With a pin and no CA file the pin alone authenticates the
+// proxy, so self-signed certificates can be used.
+func buildProxyTLS(t *ProxyTLS, host string) (*tls.Config, error) {
+	conf := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if conf.ServerName == "" {
+		conf.ServerName = host
+	}
+	if t.CAFile != "" {
+		pool, err := loadCertPool(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = pool
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	if t.PinSHA256 != "" {
+		pin, err := decodePin(t.PinSHA256)
+		if err != nil {
+			return nil, err
+		}
+		if t.CAFile == "" {
+			conf.InsecureSkipVerify = true
+		}
+		conf.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("no peer certificate")
+			}
+			sum := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+			if !bytes.Equal(sum[:], pin) {
+				return fmt.Errorf("certificate pin mismatch")
+			}
+			return nil
+		}
+	}
+	return conf, nil
+}
+
+// clientTLS returns the TLS configuration for connecting to p, or nil when
+// TLS is not enabled.
+func (p *Proxy) clientTLS() (*tls.Config, error) {
+	if p.TLS == nil || !p.TLS.Enabled {
+		return nil, nil
+	}
+	if p.tlsConfig != nil {
+		return p.tlsConfig, nil
+	}
+	return buildProxyTLS(p.TLS, p.Host)
+}
+
+// decodePin parses a base64-encoded SHA-256 digest of a certificate's
+// SubjectPublicKeyInfo.
+func decodePin(s string) ([]byte, error) {
+	pin, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(pin) != sha256.Size {
+		return nil, fmt.Errorf("pin must be a base64 SHA-256 digest")
+	}
+	return pin, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no certificates found", path)
+	}
+	return pool, nil
+}
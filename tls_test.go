@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create ca: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse ca: %v", err)
+	}
+	return &testCA{cert: cert, key: key, certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue signs a leaf certificate for 127.0.0.1 with the given subject and
+// SANs and returns it as PEM together with its key.
+func (ca *testCA) issue(t *testing.T, cn string, dns, emails []string) (certPEM, keyPEM []byte, leaf *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(time.Now().UnixNano()),
+		Subject:        pkix.Name{CommonName: cn},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:    []net.IP{net.IPv4(127, 0, 0, 1)},
+		DNSNames:       dns,
+		EmailAddresses: emails,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("create cert: %v", err)
+	}
+	leaf, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse cert: %v", err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder})
+	return certPEM, keyPEM, leaf
+}
+
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("write %s: %v", name, err)
+	}
+	return path
+}
+
+// startTLSTestServer serves handleConn behind TLS with a certificate
+// issued by ca and returns the listener and the certificate's SPKI pin.
+func startTLSTestServer(t *testing.T, ca *testCA, chains map[string]*ChainState) (net.Listener, string) {
+	t.Helper()
+	certPEM, keyPEM, leaf := ca.issue(t, "hop", nil, nil)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("key pair: %v", err)
+	}
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	ln := tls.NewListener(inner, &tls.Config{Certificates: []tls.Certificate{cert}})
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleConn(c, chains, &Listener{})
+		}
+	}()
+	sum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	return ln, base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestConnectThroughTLSHop(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog = origWarn, origDebug }()
+
+	ca := newTestCA(t)
+	caFile := writeTestFile(t, "ca.pem", ca.certPEM)
+	hop, pin := startTLSTestServer(t, ca, map[string]*ChainState{"hu": {password: "hp"}})
+	defer hop.Close()
+	plain := startTestServer(t, &Listener{}, nil)
+	defer plain.Close()
+	hopPort := hop.Addr().(*net.TCPAddr).Port
+
+	other := newTestCA(t)
+	_, _, otherLeaf := other.issue(t, "other", nil, nil)
+	otherSum := sha256.Sum256(otherLeaf.RawSubjectPublicKeyInfo)
+	wrongPin := base64.StdEncoding.EncodeToString(otherSum[:])
+
+	tests := []struct {
+		name    string
+		tls     *ProxyTLS
+		viaHop  bool
+		wantErr bool
+	}{
+		{name: "ca file", tls: &ProxyTLS{Enabled: true, CAFile: caFile}},
+		{name: "pin only", tls: &ProxyTLS{Enabled: true, PinSHA256: pin}},
+		{name: "through previous hop", tls: &ProxyTLS{Enabled: true, CAFile: caFile, PinSHA256: pin}, viaHop: true},
+		{name: "wrong pin", tls: &ProxyTLS{Enabled: true, PinSHA256: wrongPin}, wantErr: true},
+		{name: "unknown ca", tls: &ProxyTLS{Enabled: true}, wantErr: true},
+		{name: "wrong server name", tls: &ProxyTLS{Enabled: true, CAFile: caFile, ServerName: "example.com"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := startPongServer(t)
+			defer target.Close()
+			p := &Proxy{Name: "tls", Username: "hu", Password: "hp", Host: "127.0.0.1", Port: hopPort, TLS: tt.tls}
+			cfg := Config{Chains: []UserChain{{Chain: []*Hop{{Proxies: []*Proxy{p}}}}}}
+			if err := initProxies(&cfg); err != nil {
+				t.Fatalf("init: %v", err)
+			}
+			combo := []*Proxy{p}
+			if tt.viaHop {
+				combo = []*Proxy{{Name: "plain", Host: "127.0.0.1", Port: plain.Addr().(*net.TCPAddr).Port}, p}
+			}
+			conn, err := connectThrough(t.Context(), combo, "127.0.0.1", target.Addr().(*net.TCPAddr).Port)
+			if tt.wantErr {
+				if err == nil {
+					conn.Close()
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("connect: %v", err)
+			}
+			defer conn.Close()
+			if _, ok := conn.(*tls.Conn); !ok {
+				t.Fatalf("expected tls connection, got %T", conn)
+			}
+			pingPong(t, conn)
+		})
+	}
+}
+
+func TestValidateProxyTLS(t *testing.T) {
+	if err := validateProxyTLS(&ProxyTLS{Enabled: true, CertFile: "c.pem"}); err == nil {
+		t.Fatal("expected error for cert without key")
+	}
+	if err := validateProxyTLS(&ProxyTLS{Enabled: true, PinSHA256: "abc"}); err == nil {
+		t.Fatal("expected error for malformed pin")
+	}
+	if err := validateProxyTLS(&ProxyTLS{Enabled: false, PinSHA256: "abc"}); err != nil {
+		t.Fatalf("unexpected error for disabled tls: %v", err)
+	}
+}
+
+func TestHandleConnClientCertificate(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog = origWarn, origDebug }()
+
+	ca := newTestCA(t)
+	srvCert, srvKey, _ := ca.issue(t, "server", nil, nil)
+	lt := &ListenerTLS{
+		Enabled:      true,
+		CertFile:     writeTestFile(t, "server.pem", srvCert),
+		KeyFile:      writeTestFile(t, "server.key", srvKey),
+		ClientCAFile: writeTestFile(t, "ca.pem", ca.certPEM),
+		CertUser:     "any",
+	}
+	if err := validateListenerTLS(lt); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	chains := map[string]*ChainState{"alice": {password: "pass"}, "bob@example.com": {password: "pass"}}
+	l := &Listener{Address: "127.0.0.1:0", TLS: lt}
+	ln, err := l.listen()
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleConn(c, chains, l)
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	dial := func(certPEM, keyPEM []byte) net.Conn {
+		cc := &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}
+		if certPEM != nil {
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				t.Fatalf("key pair: %v", err)
+			}
+			cc.Certificates = []tls.Certificate{cert}
+		}
+		c, err := tls.Dial("tcp", ln.Addr().String(), cc)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		return c
+	}
+
+	t.Run("common name", func(t *testing.T) {
+		target := startPongServer(t)
+		defer target.Close()
+		certPEM, keyPEM, _ := ca.issue(t, "alice", nil, nil)
+		c := dial(certPEM, keyPEM)
+		defer c.Close()
+		if code := socks5Connect(t, c, "", "", target.Addr().(*net.TCPAddr)); code != 0x00 {
+			t.Fatalf("expected response 0x00, got 0x%02X", code)
+		}
+		pingPong(t, c)
+	})
+	t.Run("email san", func(t *testing.T) {
+		target := startPongServer(t)
+		defer target.Close()
+		certPEM, keyPEM, _ := ca.issue(t, "unknown", nil, []string{"bob@example.com"})
+		c := dial(certPEM, keyPEM)
+		defer c.Close()
+		if code := socks5Connect(t, c, "", "", target.Addr().(*net.TCPAddr)); code != 0x00 {
+			t.Fatalf("expected response 0x00, got 0x%02X", code)
+		}
+	})
+	t.Run("no certificate needs password", func(t *testing.T) {
+		c := dial(nil, nil)
+		defer c.Close()
+		if _, err := c.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+			t.Fatalf("handshake write: %v", err)
+		}
+		buf := make([]byte, 2)
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(c, buf); err != nil {
+			t.Fatalf("handshake read: %v", err)
+		}
+		if buf[1] != 0xFF {
+			t.Fatalf("expected method 0xFF, got 0x%02X", buf[1])
+		}
+	})
+	t.Run("unknown user needs password", func(t *testing.T) {
+		certPEM, keyPEM, _ := ca.issue(t, "mallory", nil, nil)
+		c := dial(certPEM, keyPEM)
+		defer c.Close()
+		if _, err := c.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+			t.Fatalf("handshake write: %v", err)
+		}
+		buf := make([]byte, 2)
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(c, buf); err != nil {
+			t.Fatalf("handshake read: %v", err)
+		}
+		if buf[1] != 0xFF {
+			t.Fatalf("expected method 0xFF, got 0x%02X", buf[1])
+		}
+	})
+}
+
+func TestValidateListenerTLS(t *testing.T) {
+	tests := []*ListenerTLS{
+		{Enabled: true, CertFile: "c.pem"},
+		{Enabled: true, CertFile: "c.pem", KeyFile: "k.pem", ClientAuth: "require"},
+		{Enabled: true, CertFile: "c.pem", KeyFile: "k.pem", CertUser: "cn"},
+		{Enabled: true, CertFile: "c.pem", KeyFile: "k.pem", ClientCAFile: "ca.pem", CertUser: "serial"},
+	}
+	for i, lt := range tests {
+		if err := validateListenerTLS(lt); err == nil {
+			t.Fatalf("case %d: expected error", i)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// lookupOriginalDst is replaced in tests, which cannot rely on firewall
+// rules being present.
+var lookupOriginalDst = originalDst
+
+// isTransparent reports whether l receives redirected traffic instead of
+// proxy requests.
+func (l *Listener) isTransparent() bool {
+	p := l.protocol()
+	return p == "redirect" || p == "tproxy"
+}
+
+func validateTransparent(l *Listener, chains []UserChain) error {
+	if !l.isTransparent() {
+		if len(l.SourceUsers) > 0 {
+			return fmt.Errorf("source_users requires protocol redirect or tproxy")
+		}
+		return nil
+	}
+	if _, ok := unixPath(l.Address); ok {
+		return fmt.Errorf("protocol %s requires a TCP address", l.protocol())
+	}
+	if l.TLS != nil && l.TLS.Enabled {
+		return fmt.Errorf("tls cannot be used with protocol %s", l.protocol())
+	}
+	if l.ProxyProtocol != nil && l.ProxyProtocol.Enabled {
+		return fmt.Errorf("proxy_protocol cannot be used with protocol %s", l.protocol())
+	}
+	for i, su := range l.SourceUsers {
+		if _, err := parseCIDRs([]string{su.CIDR}); err != nil {
+			return fmt.Errorf("source_users[%d]: %w", i, err)
+		}
+		if !hasUser(chains, su.User) {
+			return fmt.Errorf("source_users[%d]: user %q is not configured", i, su.User)
+		}
+	}
+	return nil
+}
+
+// sourceUser returns the user whose source_users entry matches ip first.
+func (l *Listener) sourceUser(ip net.IP, chains map[string]*ChainState) (string, *ChainState) {
+	for _, su := range l.SourceUsers {
+		nets, err := parseCIDRs([]string{su.CIDR})
+		if err != nil || !ipInNets(ip, nets) {
+			continue
+		}
+		if st, ok := chains[su.User]; ok {
+			return su.User, st
+		}
+	}
+	return "", nil
+}
+
+// handleTransparent serves a connection redirected to the listener by the
+// firewall. The destination is the connection's original destination and
+// the chain is picked from the client address rather than SOCKS auth.
+func handleTransparent(conn net.Conn, chains map[string]*ChainState, l *Listener) {
+	defer conn.Close()
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		warnLog.Printf("transparent: unsupported connection type %T", conn)
+		return
+	}
+	dst, err := lookupOriginalDst(tcp, l.protocol())
+	if err != nil {
+		warnLog.Printf("transparent: original destination: %v", err)
+		return
+	}
+	if la, ok := conn.LocalAddr().(*net.TCPAddr); ok && l.protocol() == "redirect" && dst.IP.Equal(la.IP) && dst.Port == la.Port {
+		warnLog.Printf("transparent: connection to %s was not redirected", dst)
+		return
+	}
+	src := conn.RemoteAddr().(*net.TCPAddr)
+	uname, state := l.sourceUser(src.IP, l.users(chains))
+	if state == nil && l.authRequired(chains) {
+		warnLog.Printf("transparent: no user for source %s", src.IP)
+		return
+	}
+	if uname != "" {
+		debugLog.Printf("source %s maps to user %s", src.IP, uname)
+	}
+	host, port := dst.IP.String(), dst.Port
+	dest := net.JoinHostPort(host, strconv.Itoa(port))
+	debugLog.Printf("transparent connect to %s", dest)
+	ctx, cancel := context.WithTimeout(clientContext(conn), ioTimeout)
+	defer cancel()
+	target, rule := route(ctx, state, host, port)
+	if rule.rejects() {
+		warnLog.Printf("connect to %s rejected by rules[%d]", dest, rule.index)
+		return
+	}
+	if rule.blackholes() {
+		debugLog.Printf("connect to %s blackholed by rules[%d]", dest, rule.index)
+		blackhole(conn)
+		return
+	}
+	if target != nil {
+		target.acquire()
+		defer target.release()
+	}
+	remote, err := dialTarget(ctx, target, host, port)
+	if err != nil {
+		warnLog.Printf("connect to %s failed: %v", dest, err)
+		return
+	}
+	if tcp, ok := remote.(*net.TCPConn); ok {
+		tcp.SetNoDelay(true)
+	}
+	defer remote.Close()
+	conn.SetDeadline(time.Time{})
+	remote.SetDeadline(time.Time{})
+	proxy(remote, conn)
+}
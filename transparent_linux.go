@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	soOriginalDst   = 80 // SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST
+	ipv6Transparent = 75 // IPV6_TRANSPARENT
+)
+
+// originalDst recovers the destination a redirected connection was sent
+// to. REDIRECT rewrites the destination, so it is read back from
+// conntrack; with TPROXY the socket is bound to the original destination.
+func originalDst(conn *net.TCPConn, mode string) (*net.TCPAddr, error) {
+	if mode == "tproxy" {
+		return conn.LocalAddr().(*net.TCPAddr), nil
+	}
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	ipv6 := conn.LocalAddr().(*net.TCPAddr).IP.To4() == nil
+	var dst *net.TCPAddr
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if ipv6 {
+			// IPv6MTUInfo starts with a sockaddr_in6.
+			info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+			if err != nil {
+				serr = err
+				return
+			}
+			p := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			dst = &net.TCPAddr{IP: net.IP(info.Addr.Addr[:]), Port: int(p[0])<<8 | int(p[1])}
+			return
+		}
+		// IPv6Mreq is large enough to hold the returned sockaddr_in.
+		mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+		if err != nil {
+			serr = err
+			return
+		}
+		a := mreq.Multiaddr
+		dst = &net.TCPAddr{IP: net.IPv4(a[4], a[5], a[6], a[7]), Port: int(a[2])<<8 | int(a[3])}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dst, serr
+}
+
+// transparentControl marks a listening socket IP_TRANSPARENT so it accepts
+// connections for non-local addresses diverted by TPROXY rules.
+func transparentControl(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		if network == "tcp6" {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+		} else {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+var errTransparentUnsupported = errors.New("transparent proxying is only supported on Linux")
+
+func originalDst(conn *net.TCPConn, mode string) (*net.TCPAddr, error) {
+	return nil, errTransparentUnsupported
+}
+
+func transparentControl(network, address string, c syscall.RawConn) error {
+	return errTransparentUnsupported
+}
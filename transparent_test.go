@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// serveTransparent accepts one connection on a loopback listener and hands
+// it to handleTransparent with its original destination faked as dst.
+func serveTransparent(t *testing.T, l *Listener, chains map[string]*ChainState, dst *net.TCPAddr) net.Conn {
+	t.Helper()
+	origLookup := lookupOriginalDst
+	lookupOriginalDst = func(*net.TCPConn, string) (*net.TCPAddr, error) { return dst, nil }
+	t.Cleanup(func() { lookupOriginalDst = origLookup })
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		handleTransparent(c, chains, l)
+	}()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestHandleTransparentChain(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog = origWarn, origDebug }()
+
+	target := startPongServer(t)
+	defer target.Close()
+	hop := startTestServer(t, &Listener{}, nil)
+	defer hop.Close()
+
+	cfg := Config{Chains: []UserChain{{Username: "alice", Password: "pass", Chain: []*Hop{{Name: "up", Host: "127.0.0.1", Port: hop.Addr().(*net.TCPAddr).Port}}}}}
+	initProxies(&cfg)
+	chains := map[string]*ChainState{"alice": {chain: cfg.Chains[0].Chain, password: "pass"}}
+	l := &Listener{Protocol: "redirect", SourceUsers: []SourceUser{{CIDR: "10.0.0.0/8", User: "bob"}, {CIDR: "127.0.0.0/8", User: "alice"}}}
+
+	client := serveTransparent(t, l, chains, target.Addr().(*net.TCPAddr))
+	pingPong(t, client)
+}
+
+func TestHandleTransparentUnknownSource(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog = origWarn, origDebug }()
+
+	target := startPongServer(t)
+	defer target.Close()
+
+	chains := map[string]*ChainState{"alice": {password: "pass"}}
+	l := &Listener{Protocol: "tproxy", SourceUsers: []SourceUser{{CIDR: "10.0.0.0/8", User: "alice"}}}
+	client := serveTransparent(t, l, chains, target.Addr().(*net.TCPAddr))
+	client.Write([]byte("ping"))
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 4)); err == nil {
+		t.Fatal("expected connection to be closed")
+	}
+}
+
+func TestValidateTransparent(t *testing.T) {
+	chains := []UserChain{{Username: "alice", Password: "pass"}}
+	for _, l := range []*Listener{
+		{Address: ":1080", Protocol: "socks5", SourceUsers: []SourceUser{{CIDR: "10.0.0.0/8", User: "alice"}}},
+		{Address: ":1080", Protocol: "redirect", SourceUsers: []SourceUser{{CIDR: "10.0.0.0/8", User: "bob"}}},
+		{Address: ":1080", Protocol: "redirect", SourceUsers: []SourceUser{{CIDR: "bogus", User: "alice"}}},
+		{Address: ":1080", Protocol: "tproxy", TLS: &ListenerTLS{Enabled: true, CertFile: "c", KeyFile: "k"}},
+		{Address: "unix:///run/t.sock", Protocol: "redirect"},
+	} {
+		if err := validateTransparent(l, chains); err == nil {
+			t.Fatalf("expected error for %+v", l)
+		}
+	}
+	ok := &Listener{Address: ":1080", Protocol: "redirect", SourceUsers: []SourceUser{{CIDR: "10.0.0.0/8", User: "alice"}}}
+	if err := validateTransparent(ok, chains); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const maxUDPDatagram = 64 * 1024
+
+// maxUDPPeers caps the destinations one association accepts replies from.
+const maxUDPPeers = 1024
+
+// handleUDPAssociate serves a UDP ASSOCIATE request. The relay socket stays
+// open for as long as the TCP control connection does. Users with a chain
+// get an association negotiated at the last hop and their datagrams are
+// forwarded to its relay address. Datagrams would skip the earlier hops, so
+// chains of more than one hop are refused.
+func handleUDPAssociate(ctx context.Context, conn net.Conn, state *ChainState) {
+	var relay *net.UDPAddr
+	if state != nil && len(state.chain) > 1 {
+		warnLog.Printf("udp associate not supported through a chain of %d hops, code 0x07", len(state.chain))
+		conn.SetDeadline(time.Now().Add(ioTimeout))
+		if err := writeFull(conn, encodeReply(0x07, "0.0.0.0", 0)); err != nil {
+			warnLog.Printf("write: %v", err)
+		}
+		return
+	}
+	if state != nil && len(state.chain) > 0 {
+		state.acquire()
+		defer state.release()
+		ctx, cancel := context.WithTimeout(ctx, ioTimeout)
+		upstream, bnd, err := requestChain(ctx, state, 0x03, "0.0.0.0", 0)
+		cancel()
+		if err != nil {
+			warnLog.Printf("udp associate through chain failed: %v, code 0x04", err)
+			conn.SetDeadline(time.Now().Add(ioTimeout))
+			if err := writeFull(conn, encodeReply(0x04, "0.0.0.0", 0)); err != nil {
+				warnLog.Printf("write: %v", err)
+			}
+			return
+		}
+		defer upstream.Close()
+		relay, err = net.ResolveUDPAddr("udp", net.JoinHostPort(bnd.host, strconv.Itoa(bnd.port)))
+		if err != nil {
+			warnLog.Printf("resolve upstream relay %s:%d: %v, code 0x01", bnd.host, bnd.port, err)
+			conn.SetDeadline(time.Now().Add(ioTimeout))
+			if err := writeFull(conn, encodeReply(0x01, "0.0.0.0", 0)); err != nil {
+				warnLog.Printf("write: %v", err)
+			}
+			return
+		}
+		debugLog.Printf("upstream udp relay at %s", relay)
+		go func() {
+			io.Copy(io.Discard, upstream)
+			conn.Close()
+		}()
+	}
+	var lip net.IP
+	if la, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		lip = la.IP
+	}
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: lip})
+	if err != nil {
+		warnLog.Printf("udp listen: %v, code 0x01", err)
+		conn.SetDeadline(time.Now().Add(ioTimeout))
+		if err := writeFull(conn, encodeReply(0x01, "0.0.0.0", 0)); err != nil {
+			warnLog.Printf("write: %v", err)
+		}
+		return
+	}
+	defer pc.Close()
+	la := pc.LocalAddr().(*net.UDPAddr)
+	host := la.IP.String()
+	if la.IP.IsUnspecified() {
+		host = "0.0.0.0"
+	}
+	resp := encodeReply(0x00, host, la.Port)
+	conn.SetDeadline(time.Now().Add(ioTimeout))
+	if err := writeFull(conn, resp); err != nil {
+		warnLog.Printf("write: %v", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	debugLog.Printf("server responded with %v", resp)
+	go func() {
+		io.Copy(io.Discard, conn)
+		pc.Close()
+	}()
+	var clientIP net.IP
+	if ra, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		clientIP = ra.IP
+	}
+	relayUDP(ctx, pc, clientIP, state, relay)
+}
+
+// relayUDP moves datagrams between the client and their destinations until
+// pc is closed or stays idle for idleTimeout. Only datagrams from clientIP
+// are accepted as client traffic when it is known. When relay is set,
+// client datagrams are passed on unchanged to that upstream relay, the
+// association state's chain made. Each destination goes through the
+// routing rules first: rejected and blackholed datagrams are dropped,
+// direct ones are sent from pc, and ones for another chain are dropped
+// too, as they have no association there. Replies are accepted from
+// destinations the client sent to within idleTimeout.
+func relayUDP(ctx context.Context, pc *net.UDPConn, clientIP net.IP, state *ChainState, relay *net.UDPAddr) {
+	buf := make([]byte, maxUDPDatagram)
+	var client *net.UDPAddr
+	peers := make(udpPeers)
+	for {
+		pc.SetReadDeadline(time.Now().Add(idleTimeout))
+		n, src, err := pc.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				debugLog.Printf("udp relay: idle timeout")
+			} else if !errors.Is(err, net.ErrClosed) {
+				warnLog.Printf("udp relay: %v", err)
+			}
+			return
+		}
+		switch {
+		case client == nil || udpAddrEqual(src, client):
+			if clientIP != nil && !src.IP.Equal(clientIP) {
+				debugLog.Printf("udp relay: dropping datagram from %s", src)
+				continue
+			}
+			host, port, payload, err := parseUDPHeader(buf[:n])
+			if err != nil {
+				debugLog.Printf("udp relay: %v", err)
+				continue
+			}
+			client = src
+			rctx, cancel := context.WithTimeout(ctx, ioTimeout)
+			target, rule := route(rctx, state, host, port)
+			cancel()
+			if rule.rejects() || rule.blackholes() {
+				debugLog.Printf("udp relay: datagram to %s:%d dropped by rules[%d]", host, port, rule.index)
+				continue
+			}
+			if target != nil && target != state {
+				debugLog.Printf("udp relay: datagram to %s:%d dropped, rules[%d] routes it through another chain", host, port, rule.index)
+				continue
+			}
+			if relay != nil && target != nil {
+				if _, err := pc.WriteToUDP(buf[:n], relay); err != nil {
+					warnLog.Printf("udp relay to %s: %v", relay, err)
+				}
+				continue
+			}
+			dst, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+			if err != nil {
+				warnLog.Printf("udp relay resolve %s: %v", host, err)
+				continue
+			}
+			if !peers.add(dst.String(), time.Now()) {
+				debugLog.Printf("udp relay: too many peers, dropping datagram to %s", dst)
+				continue
+			}
+			if _, err := pc.WriteToUDP(payload, dst); err != nil {
+				warnLog.Printf("udp relay to %s: %v", dst, err)
+			}
+		case relay != nil && udpAddrEqual(src, relay):
+			if _, err := pc.WriteToUDP(buf[:n], client); err != nil {
+				warnLog.Printf("udp relay to client: %v", err)
+			}
+		default:
+			if !peers.has(src.String(), time.Now()) {
+				debugLog.Printf("udp relay: dropping datagram from unknown peer %s", src)
+				continue
+			}
+			hdr, err := buildUDPHeader(src.IP.String(), src.Port)
+			if err != nil {
+				continue
+			}
+			if _, err := pc.WriteToUDP(append(hdr, buf[:n]...), client); err != nil {
+				warnLog.Printf("udp relay to client: %v", err)
+			}
+		}
+	}
+}
+
+// udpPeers records when the client last sent to each destination.
+type udpPeers map[string]time.Time
+
+// add records addr, first forgetting expired peers when the map is full.
+// It reports false when no room is left.
+func (p udpPeers) add(addr string, now time.Time) bool {
+	if _, ok := p[addr]; !ok && len(p) >= maxUDPPeers {
+		for a, seen := range p {
+			if now.Sub(seen) >= idleTimeout {
+				delete(p, a)
+			}
+		}
+		if len(p) >= maxUDPPeers {
+			return false
+		}
+	}
+	p[addr] = now
+	return true
+}
+
+func (p udpPeers) has(addr string, now time.Time) bool {
+	seen, ok := p[addr]
+	return ok && now.Sub(seen) < idleTimeout
+}
+
+func udpAddrEqual(a, b *net.UDPAddr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
+
+// parseUDPHeader splits an RFC 1928 UDP request header from its payload.
+// Fragmented datagrams are rejected.
+func parseUDPHeader(b []byte) (string, int, []byte, error) {
+	if len(b) < 4 {
+		return "", 0, nil, fmt.Errorf("short udp header")
+	}
+	if b[0] != 0 || b[1] != 0 {
+		return "", 0, nil, fmt.Errorf("bad udp header reserved field")
+	}
+	if b[2] != 0 {
+		return "", 0, nil, fmt.Errorf("udp fragmentation not supported")
+	}
+	var host string
+	off := 4
+	switch b[3] {
+	case 0x01: // IPv4
+		if len(b) < off+4 {
+			return "", 0, nil, fmt.Errorf("short udp header")
+		}
+		host = net.IP(b[off : off+4]).String()
+		off += 4
+	case 0x03: // domain
+		if len(b) < off+1 {
+			return "", 0, nil, fmt.Errorf("short udp header")
+		}
+		dlen := int(b[off])
+		off++
+		if len(b) < off+dlen {
+			return "", 0, nil, fmt.Errorf("short udp header")
+		}
+		host = string(b[off : off+dlen])
+		off += dlen
+	case 0x04: // IPv6
+		if len(b) < off+16 {
+			return "", 0, nil, fmt.Errorf("short udp header")
+		}
+		host = net.IP(b[off : off+16]).String()
+		off += 16
+	default:
+		return "", 0, nil, fmt.Errorf("bad atyp %d", b[3])
+	}
+	if len(b) < off+2 {
+		return "", 0, nil, fmt.Errorf("short udp header")
+	}
+	port := int(b[off])<<8 | int(b[off+1])
+	return host, port, b[off+2:], nil
+}
+
+// buildUDPHeader encodes an unfragmented RFC 1928 UDP request header.
+func buildUDPHeader(host string, port int) ([]byte, error) {
+	atyp, addr, err := encodeAddr(host)
+	if err != nil {
+		return nil, err
+	}
+	hdr := []byte{0x00, 0x00, 0x00, atyp}
+	hdr = append(hdr, addr...)
+	hdr = append(hdr, byte(port>>8), byte(port))
+	return hdr, nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseUDPHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		pkt      []byte
+		wantHost string
+		wantPort int
+		wantData []byte
+		wantErr  bool
+	}{
+		{
+			name:     "IPv4",
+			pkt:      []byte{0, 0, 0, 0x01, 127, 0, 0, 1, 0x00, 0x35, 'h', 'i'},
+			wantHost: "127.0.0.1",
+			wantPort: 53,
+			wantData: []byte("hi"),
+		},
+		{
+			name:     "domain",
+			pkt:      append(append([]byte{0, 0, 0, 0x03, 11}, "example.com"...), 0x01, 0xBB),
+			wantHost: "example.com",
+			wantPort: 443,
+			wantData: []byte{},
+		},
+		{
+			name:    "fragmented",
+			pkt:     []byte{0, 0, 1, 0x01, 127, 0, 0, 1, 0x00, 0x35},
+			wantErr: true,
+		},
+		{
+			name:    "truncated",
+			pkt:     []byte{0, 0, 0, 0x04, 0, 0},
+			wantErr: true,
+		},
+		{
+			name:    "bad atyp",
+			pkt:     []byte{0, 0, 0, 0x05, 0, 0},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, port, data, err := parseUDPHeader(tt.pkt)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if host != tt.wantHost || port != tt.wantPort || !bytes.Equal(data, tt.wantData) {
+				t.Fatalf("got %s:%d %q, want %s:%d %q", host, port, data, tt.wantHost, tt.wantPort, tt.wantData)
+			}
+		})
+	}
+}
+
+func TestBuildUDPHeaderRoundTrip(t *testing.T) {
+	hdr, err := buildUDPHeader("2001:db8::1", 8080)
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	host, port, data, err := parseUDPHeader(append(hdr, 'x'))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if host != "2001:db8::1" || port != 8080 || string(data) != "x" {
+		t.Fatalf("unexpected %s:%d %q", host, port, data)
+	}
+}
+
+// startUDPEcho runs a UDP server that echoes every datagram back.
+func startUDPEcho(t *testing.T) *net.UDPConn {
+	t.Helper()
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, src, err := pc.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteToUDP(buf[:n], src)
+		}
+	}()
+	return pc
+}
+
+// udpAssociate performs a no-auth UDP ASSOCIATE handshake on client and
+// returns the relay port announced by the server.
+func udpAssociate(t *testing.T, client net.Conn) int {
+	t.Helper()
+	if _, err := client.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		t.Fatalf("handshake write: %v", err)
+	}
+	buf := make([]byte, 10)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(client, buf[:2]); err != nil {
+		t.Fatalf("handshake read: %v", err)
+	}
+	if _, err := client.Write([]byte{0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0}); err != nil {
+		t.Fatalf("associate write: %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatalf("associate read: %v", err)
+	}
+	if buf[1] != 0x00 {
+		t.Fatalf("expected response 0x00, got 0x%02X", buf[1])
+	}
+	return int(buf[8])<<8 | int(buf[9])
+}
+
+func udpRoundTrip(t *testing.T, relayPort int, echo *net.UDPAddr) {
+	t.Helper()
+	uc, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: relayPort})
+	if err != nil {
+		t.Fatalf("dial udp: %v", err)
+	}
+	defer uc.Close()
+	hdr, err := buildUDPHeader(echo.IP.String(), echo.Port)
+	if err != nil {
+		t.Fatalf("header: %v", err)
+	}
+	if _, err := uc.Write(append(hdr, "ping"...)); err != nil {
+		t.Fatalf("udp write: %v", err)
+	}
+	buf := make([]byte, 1500)
+	uc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := uc.Read(buf)
+	if err != nil {
+		t.Fatalf("udp read: %v", err)
+	}
+	host, port, data, err := parseUDPHeader(buf[:n])
+	if err != nil {
+		t.Fatalf("parse reply: %v", err)
+	}
+	if host != echo.IP.String() || port != echo.Port || string(data) != "ping" {
+		t.Fatalf("unexpected reply %s:%d %q", host, port, data)
+	}
+}
+
+func TestHandleConnUDPAssociate(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog = origWarn, origDebug }()
+
+	echo := startUDPEcho(t)
+	defer echo.Close()
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() { handleConn(server, nil, &Listener{}); close(done) }()
+
+	relayPort := udpAssociate(t, client)
+	udpRoundTrip(t, relayPort, echo.LocalAddr().(*net.UDPAddr))
+
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("association did not end with the control connection")
+	}
+}
+
+func TestHandleConnUDPAssociateChain(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog = origWarn, origDebug }()
+
+	echo := startUDPEcho(t)
+	defer echo.Close()
+
+	// The upstream hop is another instance of our own server in direct mode.
+	ln := startTestServer(t, &Listener{}, nil)
+	defer ln.Close()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	cfg := Config{Chains: []UserChain{{Username: "u", Password: "p", Chain: []*Hop{{Name: "up", Host: "127.0.0.1", Port: addr.Port}}}}}
+	initProxies(&cfg)
+	state := &ChainState{chain: cfg.Chains[0].Chain, password: "p"}
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handleUDPAssociate(context.Background(), server, state)
+		server.Close()
+		close(done)
+	}()
+
+	buf := make([]byte, 10)
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatalf("associate read: %v", err)
+	}
+	if buf[1] != 0x00 {
+		t.Fatalf("expected response 0x00, got 0x%02X", buf[1])
+	}
+	udpRoundTrip(t, int(buf[8])<<8|int(buf[9]), echo.LocalAddr().(*net.UDPAddr))
+
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("association did not end with the control connection")
+	}
+}
+
+func TestHandleUDPAssociateMultiHopRefused(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog = origWarn, origDebug }()
+
+	cfg := Config{Chains: []UserChain{{Username: "u", Password: "p", Chain: []*Hop{
+		{Name: "a", Host: "127.0.0.1", Port: 1},
+		{Name: "b", Host: "127.0.0.1", Port: 2},
+	}}}}
+	initProxies(&cfg)
+	state := &ChainState{chain: cfg.Chains[0].Chain, password: "p"}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		handleUDPAssociate(context.Background(), server, state)
+		server.Close()
+	}()
+
+	buf := make([]byte, 10)
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatalf("associate read: %v", err)
+	}
+	if buf[1] != 0x07 {
+		t.Fatalf("expected response 0x07, got 0x%02X", buf[1])
+	}
+}
+
+func TestUDPPeersBounded(t *testing.T) {
+	origIdle := idleTimeout
+	idleTimeout = time.Minute
+	defer func() { idleTimeout = origIdle }()
+
+	now := time.Now()
+	peers := make(udpPeers)
+	for i := range maxUDPPeers {
+		if !peers.add(strconv.Itoa(i), now) {
+			t.Fatalf("peer %d refused below the cap", i)
+		}
+	}
+	if peers.add("new", now) {
+		t.Fatal("peer added past the cap")
+	}
+	if !peers.add("0", now.Add(2*time.Minute)) {
+		t.Fatal("known peer should be refreshed")
+	}
+	later := now.Add(2 * time.Minute)
+	if peers.has("1", later) {
+		t.Fatal("expired peer still accepted")
+	}
+	if !peers.add("new", later) || len(peers) != 2 {
+		t.Fatalf("expired peers were not evicted, %d left", len(peers))
+	}
+	if !peers.has("0", later) || !peers.has("new", later) {
+		t.Fatal("live peers were lost")
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unixPath returns the socket path of a unix:///path listener address.
+func unixPath(addr string) (string, bool) {
+	return strings.CutPrefix(addr, "unix://")
+}
+
+// isUnix reports whether l listens on a unix socket.
+func (l *Listener) isUnix() bool {
+	_, ok := unixPath(l.Address)
+	return ok
+}
+
+func validateUnixListener(l *Listener, path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("unix socket path %q must be absolute", path)
+	}
+	if l.Mode != "" {
+		if _, err := parseSocketMode(l.Mode); err != nil {
+			return err
+		}
+	}
+	if l.Owner != "" {
+		if _, _, err := lookupOwner(l.Owner); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listenUnix listens on the socket at path after removing a stale socket
+// left behind by a previous process. mode and owner, when set, are applied
+// to the socket file. The socket is then created in a private directory
+// and only moved to path once they are in place, so clients never see it
+// with the default permissions.
+func listenUnix(path, mode, owner string) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	if mode == "" && owner == "" {
+		return net.Listen("unix", path)
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".socksstrata-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "sock")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	ln.SetUnlinkOnClose(false)
+	if err := setupSocket(tmp, mode, owner); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: ln, path: path}, nil
+}
+
+func setupSocket(path, mode, owner string) error {
+	if mode != "" {
+		m, err := parseSocketMode(mode)
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(path, m); err != nil {
+			return err
+		}
+	}
+	if owner != "" {
+		uid, gid, err := lookupOwner(owner)
+		if err != nil {
+			return err
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unixListener removes the socket, which was renamed after Listen, on
+// Close.
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+// removeStaleSocket deletes the socket at path unless another process is
+// still accepting connections on it. Other file types are left alone.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		c.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	debugLog.Printf("removing stale socket %s", path)
+	return os.Remove(path)
+}
+
+// parseSocketMode parses an octal permission string such as "0660".
+func parseSocketMode(s string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || m > 0o777 {
+		return 0, fmt.Errorf("mode %q must be octal permissions such as 0660", s)
+	}
+	return os.FileMode(m), nil
+}
+
+// lookupOwner resolves "user" or "user:group", given as names or numeric
+// IDs. A missing group leaves the group unchanged.
+func lookupOwner(s string) (int, int, error) {
+	uname, gname, _ := strings.Cut(s, ":")
+	uid, gid := -1, -1
+	if uname != "" {
+		id, err := strconv.Atoi(uname)
+		if err != nil {
+			u, lerr := user.Lookup(uname)
+			if lerr != nil {
+				return 0, 0, fmt.Errorf("owner: %w", lerr)
+			}
+			id, _ = strconv.Atoi(u.Uid)
+		}
+		uid = id
+	}
+	if gname != "" {
+		id, err := strconv.Atoi(gname)
+		if err != nil {
+			g, lerr := user.LookupGroup(gname)
+			if lerr != nil {
+				return 0, 0, fmt.Errorf("owner: %w", lerr)
+			}
+			id, _ = strconv.Atoi(g.Gid)
+		}
+		gid = id
+	}
+	return uid, gid, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestUnixListener(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog = origWarn, origDebug }()
+
+	path := filepath.Join(t.TempDir(), "socks.sock")
+	owner := strconv.Itoa(os.Getuid()) + ":" + strconv.Itoa(os.Getgid())
+	l := &Listener{Address: "unix://" + path, Mode: "0600", Owner: owner}
+	cfg := Config{Listeners: []*Listener{l}}
+	if err := validateListeners(&cfg); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	ln, err := l.listen()
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Fatalf("unexpected mode %v", fi.Mode().Perm())
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleConn(c, nil, l)
+		}
+	}()
+
+	// A second listener must not steal a socket that is in use.
+	if _, err := (&Listener{Address: l.Address}).listen(); err == nil {
+		t.Fatal("expected error for socket in use")
+	}
+
+	target := startPongServer(t)
+	defer target.Close()
+	client, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+	if code := socks5Connect(t, client, "", "", target.Addr().(*net.TCPAddr)); code != 0x00 {
+		t.Fatalf("expected success, got 0x%02X", code)
+	}
+	pingPong(t, client)
+
+	// The socket was set up in a private directory and moved into place.
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatalf("readdir: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected only the socket, found %d entries", len(entries))
+	}
+	ln.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket left behind after close: %v", err)
+	}
+}
+
+func TestUnixListenerStaleSocket(t *testing.T) {
+	origDebug := debugLog
+	debugLog = nopLogger{}
+	defer func() { debugLog = origDebug }()
+
+	path := filepath.Join(t.TempDir(), "stale.sock")
+	old, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	old.SetUnlinkOnClose(false)
+	old.Close()
+
+	ln, err := (&Listener{Address: "unix://" + path}).listen()
+	if err != nil {
+		t.Fatalf("listen over stale socket: %v", err)
+	}
+	ln.Close()
+
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := (&Listener{Address: "unix://" + path}).listen(); err == nil {
+		t.Fatal("expected error for regular file")
+	}
+}
+
+func TestValidateUnixListener(t *testing.T) {
+	for _, l := range []*Listener{
+		{Address: "unix://relative.sock"},
+		{Address: "unix:///run/s.sock", Mode: "rw"},
+		{Address: "unix:///run/s.sock", Mode: "1777"},
+		{Address: "127.0.0.1:1080", Mode: "0600"},
+	} {
+		if err := validateListeners(&Config{Listeners: []*Listener{l}}); err == nil {
+			t.Fatalf("expected error for %+v", l)
+		}
+	}
+}
+
+func TestUnixListenerRejectsBindAndUDP(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog = origWarn, origDebug }()
+
+	l := &Listener{Address: "unix:///run/socks.sock"}
+	for _, cmd := range []byte{0x02, 0x03} {
+		client, server := net.Pipe()
+		done := make(chan struct{})
+		go func() { handleConn(server, nil, l); close(done) }()
+
+		client.SetDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 10)
+		if _, err := client.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+			t.Fatalf("handshake write: %v", err)
+		}
+		if _, err := io.ReadFull(client, buf[:2]); err != nil {
+			t.Fatalf("handshake read: %v", err)
+		}
+		if _, err := client.Write([]byte{0x05, cmd, 0x00, 0x01, 127, 0, 0, 1, 0, 0}); err != nil {
+			t.Fatalf("request write: %v", err)
+		}
+		if _, err := io.ReadFull(client, buf); err != nil {
+			t.Fatalf("reply read: %v", err)
+		}
+		if buf[1] != 0x07 {
+			t.Fatalf("%s: expected reply 0x07, got 0x%02X", cmdName(cmd), buf[1])
+		}
+		client.Close()
+		<-done
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import "sort"
+
+// weight returns the weight of p in h, treating 0 as 1.
+func (h *Hop) weight(p *Proxy) int {
+	if w := h.member(p).weight; w > 0 {
+		return w
+	}
+	return 1
+}
+
+// orderWeighted picks the first proxy with smooth weighted round-robin, so
+// that over time each proxy leads in proportion to its weight without
+// bursts. The remaining proxies follow as fallbacks, heaviest first.
+func (h *Hop) orderWeighted(proxies []*Proxy) []*Proxy {
+	h.wrrMu.Lock()
+	defer h.wrrMu.Unlock()
+	if h.wrrCurrent == nil {
+		h.wrrCurrent = make(map[*Proxy]int)
+	}
+	total := 0
+	best := 0
+	for i, p := range proxies {
+		w := h.weight(p)
+		h.wrrCurrent[p] += w
+		total += w
+		if h.wrrCurrent[p] > h.wrrCurrent[proxies[best]] {
+			best = i
+		}
+	}
+	h.wrrCurrent[proxies[best]] -= total
+	ordered := make([]*Proxy, 0, len(proxies))
+	ordered = append(ordered, proxies[best])
+	rest := append(append([]*Proxy(nil), proxies[:best]...), proxies[best+1:]...)
+	sort.SliceStable(rest, func(i, j int) bool { return h.weight(rest[i]) > h.weight(rest[j]) })
+	return append(ordered, rest...)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWeightedStrategy(t *testing.T) {
+	a := &Proxy{Name: "a", Host: "h1", Port: 1, Weight: 3}
+	b := &Proxy{Name: "b", Host: "h2", Port: 2, Weight: 2}
+	c := &Proxy{Name: "c", Host: "h3", Port: 3}
+	cfg := Config{Chains: []UserChain{{Chain: []*Hop{{Strategy: "weighted", Proxies: []*Proxy{a, b, c}}}}}}
+	initProxies(&cfg)
+	hop := cfg.Chains[0].Chain[0]
+
+	var seq []string
+	counts := make(map[*Proxy]int)
+	for i := 0; i < 12; i++ {
+		res := hop.orderedProxies(dialInfo{})
+		if len(res) != 3 {
+			t.Fatalf("expected 3 proxies, got %d", len(res))
+		}
+		counts[res[0]]++
+		seq = append(seq, res[0].Name)
+	}
+	if counts[a] != 6 || counts[b] != 4 || counts[c] != 2 {
+		t.Fatalf("unexpected distribution %v", seq)
+	}
+	// Smooth WRR interleaves picks within a cycle instead of sending
+	// bursts to a.
+	for i := 1; i < 6; i++ {
+		if seq[i] == "a" && seq[i-1] == "a" {
+			t.Fatalf("consecutive picks of a in %v", seq)
+		}
+	}
+}
+
+func TestLeastConnStrategy(t *testing.T) {
+	p1 := &Proxy{Name: "p1", Host: "h1", Port: 1}
+	p2 := &Proxy{Name: "p2", Host: "h2", Port: 2}
+	p3 := &Proxy{Name: "p3", Host: "h3", Port: 3}
+	cfg := Config{Chains: []UserChain{{Chain: []*Hop{{Strategy: "least_conn", Proxies: []*Proxy{p1, p2, p3}}}}}}
+	initProxies(&cfg)
+	hop := cfg.Chains[0].Chain[0]
+	p1.active.Store(4)
+	p2.active.Store(1)
+	p3.active.Store(2)
+	res := hop.orderedProxies(dialInfo{})
+	if res[0] != p2 || res[1] != p3 || res[2] != p1 {
+		t.Fatalf("unexpected order: %v", res)
+	}
+}
+
+func TestProxyCountsActive(t *testing.T) {
+	origWarn, origDebug := warnLog, debugLog
+	warnLog, debugLog = nopLogger{}, nopLogger{}
+	defer func() { warnLog, debugLog = origWarn, origDebug }()
+
+	p := &Proxy{Name: "p"}
+	a, remote := net.Pipe()
+	b, client := net.Pipe()
+	done := make(chan struct{})
+	go func() { proxy(&chainConn{Conn: a, combo: []*Proxy{p}}, b); close(done) }()
+
+	deadline := time.Now().Add(time.Second)
+	for p.active.Load() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("connection not counted as active")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	client.Close()
+	remote.Close()
+	<-done
+	if n := p.active.Load(); n != 0 {
+		t.Fatalf("expected 0 active connections, got %d", n)
+	}
+}